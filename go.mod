@@ -11,6 +11,6 @@ require (
 	golang.org/x/sys v0.0.0-20210903071746-97244b99971b
 	golang.zx2c4.com/wireguard/windows v0.4.5
 	gopkg.in/Knetic/govaluate.v3 v3.0.0 // indirect
-	gopkg.in/yaml.v2 v2.2.8 // indirect
+	gopkg.in/yaml.v2 v2.2.8
 	gopkg.in/yaml.v3 v3.0.0-20200313102051-9f266ea9e77c
 )
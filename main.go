@@ -10,6 +10,7 @@ import (
 	"os"
 	"path/filepath"
 	"strconv"
+	"strings"
 )
 
 func fatal(v ...interface{}) {
@@ -40,7 +41,11 @@ func execElevatedManagerServiceInstaller() error {
 		return err
 	}
 
-	err = elevate.ShellExecute(path, "-startmanager", "", windows.SW_SHOW)
+	args := "-startmanager"
+	if configDir := manager.ConfigDirOverride(); configDir != "" {
+		args = "-config-dir " + windows.EscapeArg(configDir) + " " + args
+	}
+	err = elevate.ShellExecute(path, args, "", windows.SW_SHOW)
 	if err != nil && err != windows.ERROR_CANCELLED {
 		return err
 	}
@@ -58,6 +63,11 @@ func pipeFromHandleArgument(handleStr string) (*os.File, error) {
 
 func main() {
 
+	if len(os.Args) > 2 && os.Args[1] == "-config-dir" {
+		manager.SetConfigDirOverride(os.Args[2])
+		os.Args = append(os.Args[:1], os.Args[3:]...)
+	}
+
 	if len(os.Args) <= 1 {
 		checkForAdminGroup()
 		err := execElevatedManagerServiceInstaller()
@@ -116,7 +126,7 @@ func main() {
 		//}
 
 		manager.InitializeIPCClient(readPipe, writePipe, eventPipe)
-		//ui.IsAdmin = isAdmin
+		manager.IsAdmin = isAdmin
 		ui.RunUI()
 		return
 
@@ -128,7 +138,11 @@ func main() {
 		return
 	case "-startmanager":
 
-		err := manager.InstallManagerService()
+		err := manager.SaveConfigDirSetting(manager.ConfigDirOverride())
+		if err != nil {
+			fatal(err)
+		}
+		err = manager.InstallManagerService()
 		if err != nil {
 			fatal(err)
 		}
@@ -149,6 +163,205 @@ func main() {
 		tunnelName := filepath.Base(os.Args[2])
 		manager.RunTunnelService(tunnelName, os.Args[2])
 
+		os.Exit(0)
+	case "-import":
+		if len(os.Args) <= 2 {
+			fmt.Printf("-import needs bundle path")
+			return
+		}
+
+		tunnelName := ""
+		if len(os.Args) > 3 {
+			tunnelName = os.Args[3]
+		}
+		name, err := manager.ImportTunnelBundle(manager.ConfigRoots(), manager.UserConfigRoot().Path, os.Args[2], tunnelName)
+		if err != nil {
+			fatal(err)
+		}
+		fmt.Printf("Imported tunnel %s\n", name)
+
+		os.Exit(0)
+	case "-enroll":
+		if len(os.Args) <= 2 {
+			fmt.Printf("-enroll needs enrollment link")
+			return
+		}
+
+		err := ui.Enroll(os.Args[2])
+		if err != nil {
+			fatal(err)
+		}
+
+		os.Exit(0)
+	case "-templates":
+		for _, t := range manager.ListTemplates(manager.ConfigRoots()) {
+			fmt.Printf("%s (%s) %s\n", t.Name, t.Source, t.Manifest.Description)
+			for _, v := range t.Manifest.Variables {
+				required := ""
+				if v.Required {
+					required = ", required"
+				}
+				fmt.Printf("    %s (%s%s) %s\n", v.Name, v.Type, required, v.Description)
+			}
+		}
+
+		os.Exit(0)
+	case "-new":
+		if len(os.Args) <= 3 {
+			fmt.Printf("-new needs template name and tunnel name")
+			return
+		}
+
+		values := make(map[string]string)
+		for _, arg := range os.Args[4:] {
+			parts := strings.SplitN(arg, "=", 2)
+			if len(parts) != 2 {
+				fatalf("Variable %s must be given as name=value", arg)
+			}
+			values[parts[0]] = parts[1]
+		}
+		t, err := manager.FindTemplate(manager.ConfigRoots(), os.Args[2])
+		if err != nil {
+			fatal(err)
+		}
+		err = t.Render(manager.UserConfigRoot().Path, os.Args[3], values)
+		if err != nil {
+			fatal(err)
+		}
+		fmt.Printf("Created tunnel %s from template %s\n", os.Args[3], os.Args[2])
+
+		os.Exit(0)
+	case "-export":
+		if len(os.Args) <= 3 {
+			fmt.Printf("-export needs tunnel name and bundle path")
+			return
+		}
+
+		includeKey := len(os.Args) > 4 && os.Args[4] == "-include-key"
+		tunnelPath, _, err := manager.FindTunnelPath(manager.ConfigRoots(), os.Args[2])
+		if err != nil {
+			fatal(err)
+		}
+		err = manager.ExportTunnelBundle(tunnelPath, os.Args[3], includeKey)
+		if err != nil {
+			fatal(err)
+		}
+		fmt.Printf("Exported tunnel %s to %s\n", os.Args[2], os.Args[3])
+
+		os.Exit(0)
+	case "-effective-config":
+		if len(os.Args) <= 2 {
+			fmt.Printf("-effective-config needs tunnel name")
+			return
+		}
+
+		tunnelPath, _, err := manager.FindTunnelPath(manager.ConfigRoots(), os.Args[2])
+		if err != nil {
+			fatal(err)
+		}
+		config, err := manager.EffectiveConfig(tunnelPath)
+		if err != nil {
+			fatal(err)
+		}
+		fmt.Print(config)
+
+		os.Exit(0)
+	case "-lint":
+		manager.LoadTunnelConfigs()
+		conflicts := manager.LintTunnels(manager.Tunnels.Snapshot())
+		for _, c := range conflicts {
+			fmt.Println(c)
+		}
+		if len(conflicts) > 0 {
+			os.Exit(1)
+		}
+
+		os.Exit(0)
+	case "-rotate-key":
+		if len(os.Args) <= 2 {
+			fmt.Printf("-rotate-key needs tunnel name")
+			return
+		}
+
+		tunnelPath, _, err := manager.FindTunnelPath(manager.ConfigRoots(), os.Args[2])
+		if err != nil {
+			fatal(err)
+		}
+		err = manager.UpdateTunnelMetadata(tunnelPath, func(md *manager.ConfigMetadata) error {
+			if md.ControllerURL == "" {
+				return fmt.Errorf("tunnel %s is not managed by a controller", os.Args[2])
+			}
+			if md.KeyPolicy == nil {
+				md.KeyPolicy = &manager.KeyPolicyConfig{}
+			}
+			md.KeyPolicy.RotateNow = true
+			return nil
+		})
+		if err != nil {
+			fatal(err)
+		}
+		fmt.Printf("The key of tunnel %s will be rotated on its next activation\n", os.Args[2])
+
+		os.Exit(0)
+	case "-update-default":
+		// -update-default [-force] [tunnel...] updates every tunnel built on the default config if none are named
+		force := len(os.Args) > 2 && os.Args[2] == "-force"
+		names := os.Args[2:]
+		if force {
+			names = os.Args[3:]
+		}
+
+		var tunnelPaths []string
+		if len(names) == 0 {
+			manager.LoadTunnelConfigs()
+			for _, t := range manager.Tunnels.Snapshot() {
+				if manager.UsesDefaultConfig(t.Path) {
+					tunnelPaths = append(tunnelPaths, t.Path)
+				}
+			}
+		}
+		for _, name := range names {
+			tunnelPath, _, err := manager.FindTunnelPath(manager.ConfigRoots(), name)
+			if err != nil {
+				fatal(err)
+			}
+			tunnelPaths = append(tunnelPaths, tunnelPath)
+		}
+
+		failed := false
+		for _, tunnelPath := range tunnelPaths {
+			changed, err := manager.UpdateDefaultConfig(tunnelPath, force)
+			switch {
+			case err != nil:
+				fmt.Printf("%s: %s\n", filepath.Base(tunnelPath), err)
+				failed = true
+			case changed:
+				fmt.Printf("%s: updated\n", filepath.Base(tunnelPath))
+			default:
+				fmt.Printf("%s: up to date\n", filepath.Base(tunnelPath))
+			}
+		}
+		if failed {
+			os.Exit(1)
+		}
+
+		os.Exit(0)
+	case "-rename-display":
+		if len(os.Args) <= 3 {
+			fmt.Printf("-rename-display needs tunnel name and display name")
+			return
+		}
+
+		tunnelPath, _, err := manager.FindTunnelPath(manager.ConfigRoots(), os.Args[2])
+		if err != nil {
+			fatal(err)
+		}
+		err = manager.SetTunnelDisplayName(tunnelPath, os.Args[3])
+		if err != nil {
+			fatal(err)
+		}
+		fmt.Printf("Tunnel %s is now displayed as %s\n", os.Args[2], os.Args[3])
+
 		os.Exit(0)
 	case "-rmtunnel":
 		if len(os.Args) <= 2 {
@@ -0,0 +1,207 @@
+package manager
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Staged and previous files get suffixes nebula does not load and the config watcher does not watch.
+const (
+	stagedSuffix       = ".staged"
+	previousSuffix     = ".previous"
+	previousJournal    = "generation.previous"
+	artifactPermission = 0600
+)
+
+// artifactGeneration records which files the last commit replaced, so that it can be rolled back.
+type artifactGeneration struct {
+	Replaced  []string  `json:"replaced"`
+	Created   []string  `json:"created"`
+	Committed time.Time `json:"committed"`
+}
+
+var artifactLock sync.Mutex
+
+// ArtifactTransaction collects the generated files of a tunnel, such as its key, certificate and controller config,
+// and swaps them into the tunnel directory together. The files it replaces are kept as the previous generation until
+// the next commit, so a tunnel that fails to start with new artifacts can be rolled back.
+type ArtifactTransaction struct {
+	dir   string
+	files map[string][]byte
+}
+
+func NewArtifactTransaction(dir string) *ArtifactTransaction {
+	return &ArtifactTransaction{dir: dir, files: make(map[string][]byte)}
+}
+
+// Put stages contents for a file in the tunnel directory. Files whose contents do not change are left out of the
+// commit.
+func (tx *ArtifactTransaction) Put(name string, contents []byte) {
+	if existing, err := ioutil.ReadFile(filepath.Join(tx.dir, name)); err == nil && bytes.Equal(existing, contents) {
+		delete(tx.files, name)
+		return
+	}
+	tx.files[name] = contents
+}
+
+// Len returns the number of files that the commit will change.
+func (tx *ArtifactTransaction) Len() int {
+	return len(tx.files)
+}
+
+func (tx *ArtifactTransaction) names() []string {
+	names := make([]string, 0, len(tx.files))
+	for name := range tx.files {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+func (tx *ArtifactTransaction) path(name string, suffix string) string {
+	return filepath.Join(tx.dir, name+suffix)
+}
+
+// Commit writes and fsyncs every staged file next to its destination and then renames them into place. If any step
+// fails the directory is left as it was before the commit.
+func (tx *ArtifactTransaction) Commit() error {
+	if len(tx.files) == 0 {
+		return nil
+	}
+	artifactLock.Lock()
+	defer artifactLock.Unlock()
+
+	names := tx.names()
+	for _, name := range names {
+		if name != filepath.Base(name) {
+			return fmt.Errorf("invalid artifact name %q", name)
+		}
+	}
+
+	cleanupStaged := func() {
+		for _, name := range names {
+			os.Remove(tx.path(name, stagedSuffix))
+		}
+	}
+	for _, name := range names {
+		err := writeFileSync(tx.path(name, stagedSuffix), tx.files[name], artifactPermission)
+		if err != nil {
+			cleanupStaged()
+			return err
+		}
+	}
+
+	// The previous generation is replaced by the one that is current now
+	discardPreviousGeneration(tx.dir)
+	gen := artifactGeneration{Committed: time.Now()}
+	for _, name := range names {
+		if _, err := os.Stat(filepath.Join(tx.dir, name)); err == nil {
+			gen.Replaced = append(gen.Replaced, name)
+		} else {
+			gen.Created = append(gen.Created, name)
+		}
+	}
+	journal, err := json.MarshalIndent(gen, "", "  ")
+	if err == nil {
+		err = writeFileSync(filepath.Join(tx.dir, previousJournal), journal, artifactPermission)
+	}
+	if err != nil {
+		cleanupStaged()
+		return err
+	}
+
+	for _, name := range gen.Replaced {
+		err = os.Rename(filepath.Join(tx.dir, name), tx.path(name, previousSuffix))
+		if err != nil {
+			rollbackGeneration(tx.dir, &gen)
+			cleanupStaged()
+			return err
+		}
+	}
+	for _, name := range names {
+		err = os.Rename(tx.path(name, stagedSuffix), filepath.Join(tx.dir, name))
+		if err != nil {
+			rollbackGeneration(tx.dir, &gen)
+			cleanupStaged()
+			return err
+		}
+	}
+	return nil
+}
+
+func readPreviousGeneration(dir string) (*artifactGeneration, error) {
+	journal, err := ioutil.ReadFile(filepath.Join(dir, previousJournal))
+	if err != nil {
+		return nil, err
+	}
+	var gen artifactGeneration
+	err = json.Unmarshal(journal, &gen)
+	if err != nil {
+		return nil, err
+	}
+	return &gen, nil
+}
+
+// rollbackGeneration restores the files a commit replaced and removes the ones it created.
+func rollbackGeneration(dir string, gen *artifactGeneration) error {
+	var errs []string
+	for _, name := range gen.Created {
+		if err := os.Remove(filepath.Join(dir, name)); err != nil && !os.IsNotExist(err) {
+			errs = append(errs, err.Error())
+		}
+	}
+	for _, name := range gen.Replaced {
+		previous := filepath.Join(dir, name+previousSuffix)
+		if _, err := os.Stat(previous); err != nil {
+			continue
+		}
+		if err := os.Rename(previous, filepath.Join(dir, name)); err != nil {
+			errs = append(errs, err.Error())
+		}
+	}
+	if len(errs) > 0 {
+		return errors.New(strings.Join(errs, "; "))
+	}
+	return os.Remove(filepath.Join(dir, previousJournal))
+}
+
+func discardPreviousGeneration(dir string) {
+	gen, err := readPreviousGeneration(dir)
+	if err != nil {
+		return
+	}
+	for _, name := range gen.Replaced {
+		os.Remove(filepath.Join(dir, name+previousSuffix))
+	}
+	os.Remove(filepath.Join(dir, previousJournal))
+}
+
+// RollbackArtifacts restores the generation of artifacts that the last commit in dir replaced.
+func RollbackArtifacts(dir string) error {
+	artifactLock.Lock()
+	defer artifactLock.Unlock()
+
+	gen, err := readPreviousGeneration(dir)
+	if os.IsNotExist(err) {
+		return errors.New("there is no previous generation to roll back to")
+	}
+	if err != nil {
+		return err
+	}
+	err = rollbackGeneration(dir, gen)
+	if err != nil {
+		return err
+	}
+	log.Printf("Rolled back artifacts of %s committed at %s", dir, gen.Committed.Format(time.RFC3339))
+	return nil
+}
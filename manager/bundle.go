@@ -0,0 +1,646 @@
+package manager
+
+import (
+	"archive/tar"
+	"archive/zip"
+	"bytes"
+	"compress/gzip"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/slackhq/nebula/cert"
+	"gopkg.in/yaml.v3"
+	"io"
+	"io/ioutil"
+	"os"
+	"path"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strings"
+	"time"
+)
+
+const (
+	maxBundleFileSize  = 1 << 20
+	maxBundleFileCount = 64
+	bundleManifestName = "manifest.json"
+)
+
+type BundleManifest struct {
+	TunnelName  string    `json:"tunnel_name"`
+	ExportedAt  time.Time `json:"exported_at"`
+	Files       []string  `json:"files"`
+	KeyIncluded bool      `json:"key_included"`
+}
+
+var invalidTunnelNameChars = regexp.MustCompile(`[^A-Za-z0-9._-]+`)
+
+// bundleFiles maps the base name of every file in a tunnel bundle to its contents.
+type bundleFiles map[string][]byte
+
+func bundleEntryName(name string) (string, error) {
+	name = strings.ReplaceAll(name, "\\", "/")
+	if strings.HasPrefix(name, "/") || filepath.VolumeName(name) != "" {
+		return "", fmt.Errorf("bundle entry %s has an absolute path", name)
+	}
+	for _, part := range strings.Split(name, "/") {
+		if part == ".." {
+			return "", fmt.Errorf("bundle entry %s escapes the bundle", name)
+		}
+	}
+	return path.Clean(name), nil
+}
+
+func addBundleFile(files bundleFiles, name string, r io.Reader) error {
+	name, err := bundleEntryName(name)
+	if err != nil {
+		return err
+	}
+	if strings.Count(name, "/") > 1 {
+		return fmt.Errorf("bundle entry %s is nested too deeply", name)
+	}
+	if len(files) >= maxBundleFileCount {
+		return errors.New("bundle contains too many files")
+	}
+
+	contents, err := ioutil.ReadAll(io.LimitReader(r, maxBundleFileSize+1))
+	if err != nil {
+		return err
+	}
+	if len(contents) > maxBundleFileSize {
+		return fmt.Errorf("bundle entry %s is too large", name)
+	}
+
+	base := path.Base(name)
+	if _, ok := files[base]; ok {
+		return fmt.Errorf("bundle contains %s more than once", base)
+	}
+	files[base] = contents
+	return nil
+}
+
+func readZipBundle(archivePath string) (bundleFiles, error) {
+	zr, err := zip.OpenReader(archivePath)
+	if err != nil {
+		return nil, err
+	}
+	defer zr.Close()
+
+	files := make(bundleFiles)
+	for _, f := range zr.File {
+		if f.FileInfo().IsDir() {
+			continue
+		}
+		if !f.Mode().IsRegular() {
+			return nil, fmt.Errorf("bundle entry %s is not a regular file", f.Name)
+		}
+		rc, err := f.Open()
+		if err != nil {
+			return nil, err
+		}
+		err = addBundleFile(files, f.Name, rc)
+		rc.Close()
+		if err != nil {
+			return nil, err
+		}
+	}
+	return files, nil
+}
+
+func readTarGzBundle(archivePath string) (bundleFiles, error) {
+	f, err := os.Open(archivePath)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	gz, err := gzip.NewReader(f)
+	if err != nil {
+		return nil, err
+	}
+	defer gz.Close()
+
+	files := make(bundleFiles)
+	tr := tar.NewReader(gz)
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, err
+		}
+		switch hdr.Typeflag {
+		case tar.TypeDir:
+			continue
+		case tar.TypeReg, tar.TypeRegA:
+		default:
+			return nil, fmt.Errorf("bundle entry %s is not a regular file", hdr.Name)
+		}
+		err = addBundleFile(files, hdr.Name, tr)
+		if err != nil {
+			return nil, err
+		}
+	}
+	return files, nil
+}
+
+func readBundle(archivePath string) (bundleFiles, error) {
+	lower := strings.ToLower(archivePath)
+	switch {
+	case strings.HasSuffix(lower, ".zip"):
+		return readZipBundle(archivePath)
+	case strings.HasSuffix(lower, ".tar.gz"), strings.HasSuffix(lower, ".tgz"):
+		return readTarGzBundle(archivePath)
+	}
+	return nil, errors.New("bundle must be a .zip or .tar.gz archive")
+}
+
+func isYAMLFile(name string) bool {
+	ext := strings.ToLower(filepath.Ext(name))
+	return ext == ".yml" || ext == ".yaml"
+}
+
+// bundlePKIName returns the name of the bundled file a pki.* path refers to. Bundles are unpacked flat into the
+// tunnel directory, which the tunnel service runs in.
+func bundlePKIName(value string) string {
+	return path.Base(strings.ReplaceAll(value, "\\", "/"))
+}
+
+// flattenPKIPaths rewrites the pki.* paths of a bundled nebula config to the bare names of the files they refer to,
+// so they resolve inside the tunnel directory after import. Configs that need no change are returned unchanged.
+func flattenPKIPaths(contents []byte) ([]byte, error) {
+	var doc yaml.Node
+	err := yaml.Unmarshal(contents, &doc)
+	if err != nil {
+		return nil, err
+	}
+	pki := pkiMapping(&doc)
+	if pki == nil {
+		return contents, nil
+	}
+
+	changed := false
+	for j := 0; j+1 < len(pki.Content); j += 2 {
+		value := pki.Content[j+1]
+		switch pki.Content[j].Value {
+		case "ca", "cert", "key":
+		default:
+			continue
+		}
+		if value.Kind != yaml.ScalarNode || value.Value == "" || strings.Contains(value.Value, "-----BEGIN") {
+			continue
+		}
+		if name := bundlePKIName(value.Value); name != value.Value {
+			value.Value = name
+			value.Style = 0
+			changed = true
+		}
+	}
+	if !changed {
+		return contents, nil
+	}
+	return encodeYAML(&doc)
+}
+
+// bundlePKI resolves a pki.* setting to PEM bytes. nebula accepts either inline PEM or a path, which for a bundle
+// has to point at one of the bundled files.
+func bundlePKI(files bundleFiles, value string, fallback string) ([]byte, error) {
+	if strings.Contains(value, "-----BEGIN") {
+		return []byte(value), nil
+	}
+	name := fallback
+	if value != "" {
+		name = bundlePKIName(value)
+	}
+	contents, ok := files[name]
+	if !ok {
+		return nil, fmt.Errorf("bundle does not contain %s", name)
+	}
+	return contents, nil
+}
+
+func validateBundle(files bundleFiles, manifest *BundleManifest) error {
+	var yamlNames []string
+	for name := range files {
+		if isYAMLFile(name) {
+			yamlNames = append(yamlNames, name)
+		}
+	}
+	sort.Strings(yamlNames)
+
+	controllerManaged := false
+	if metadataBytes, ok := files[metadataFileName]; ok {
+		md, _, err := parseTunnelMetadata(metadataFileName, metadataBytes)
+		if err != nil {
+			return err
+		}
+		controllerManaged = md.ControllerURL != ""
+	}
+	if len(yamlNames) == 0 && !controllerManaged {
+		return errors.New("bundle does not contain a nebula config")
+	}
+
+	// nebula merges config files in lexical order, so the last pki setting wins
+	var pki struct {
+		CA   string `yaml:"ca"`
+		Cert string `yaml:"cert"`
+		Key  string `yaml:"key"`
+	}
+	for _, name := range yamlNames {
+		var doc struct {
+			PKI map[string]interface{} `yaml:"pki"`
+		}
+		err := yaml.Unmarshal(files[name], &doc)
+		if err != nil {
+			return fmt.Errorf("%s is not valid YAML: %s", name, err)
+		}
+		if v, ok := doc.PKI["ca"].(string); ok {
+			pki.CA = v
+		}
+		if v, ok := doc.PKI["cert"].(string); ok {
+			pki.Cert = v
+		}
+		if v, ok := doc.PKI["key"].(string); ok {
+			pki.Key = v
+		}
+	}
+
+	if controllerManaged {
+		// The controller issues the certificate and key when the tunnel is first activated
+		return nil
+	}
+
+	caPEM, err := bundlePKI(files, pki.CA, "ca.crt")
+	if err != nil {
+		return err
+	}
+	certPEM, err := bundlePKI(files, pki.Cert, "host.crt")
+	if err != nil {
+		return err
+	}
+	keyPEM, err := bundlePKI(files, pki.Key, "host.key")
+	if err != nil {
+		if manifest != nil && !manifest.KeyIncluded {
+			// The tunnel could never start, so there is no point in importing it
+			return fmt.Errorf("bundle was exported without its private key: %s", err)
+		}
+		return err
+	}
+
+	return validatePKI(caPEM, certPEM, keyPEM)
+}
+
+func validatePKI(caPEM []byte, certPEM []byte, keyPEM []byte) error {
+	caPool, err := cert.NewCAPoolFromBytes(caPEM)
+	if err != nil {
+		return fmt.Errorf("invalid CA certificate: %s", err)
+	}
+	nc, _, err := cert.UnmarshalNebulaCertificateFromPEM(certPEM)
+	if err != nil {
+		return fmt.Errorf("invalid host certificate: %s", err)
+	}
+	ok, err := nc.Verify(time.Now(), caPool)
+	if !ok {
+		return fmt.Errorf("host certificate is not valid for the bundled CA: %s", err)
+	}
+	if keyPEM == nil {
+		return nil
+	}
+	key, _, err := cert.UnmarshalX25519PrivateKey(keyPEM)
+	if err != nil {
+		return fmt.Errorf("invalid host key: %s", err)
+	}
+	err = nc.VerifyPrivateKey(key)
+	if err != nil {
+		return fmt.Errorf("host key does not match the host certificate: %s", err)
+	}
+	return nil
+}
+
+func SanitizeTunnelName(name string) string {
+	name = invalidTunnelNameChars.ReplaceAllString(name, "-")
+	return strings.Trim(name, ".-")
+}
+
+// uniqueTunnelName picks a directory name that is not in use in any of roots yet, suffixing the requested name if
+// needed. A name taken in another root would be hidden by it, see loadAllTunnels.
+func uniqueTunnelName(roots []ConfigRoot, name string) (string, error) {
+	name = SanitizeTunnelName(name)
+	if name == "" {
+		return "", errors.New("tunnel name is empty")
+	}
+
+	inUse := func(candidate string) bool {
+		for _, r := range roots {
+			if _, err := os.Stat(filepath.Join(r.Path, candidate)); !os.IsNotExist(err) {
+				return true
+			}
+		}
+		return false
+	}
+	candidate := name
+	for i := 2; i < 100; i++ {
+		if !inUse(candidate) {
+			return candidate, nil
+		}
+		candidate = fmt.Sprintf("%s-%d", name, i)
+	}
+	return "", fmt.Errorf("could not find a free tunnel name for %s", name)
+}
+
+func bundleBaseName(archivePath string) string {
+	name := filepath.Base(archivePath)
+	for _, ext := range []string{".tar.gz", ".tgz", ".zip"} {
+		if strings.HasSuffix(strings.ToLower(name), ext) {
+			return name[:len(name)-len(ext)]
+		}
+	}
+	return name
+}
+
+// writeTunnelDir writes files into a staging directory under root and renames it into place, so a tunnel directory
+// only ever appears complete.
+func writeTunnelDir(root string, name string, files map[string][]byte) error {
+	err := os.MkdirAll(root, 0700)
+	if err != nil {
+		return err
+	}
+
+	stagingDir, err := ioutil.TempDir(root, ".staging-")
+	if err != nil {
+		return err
+	}
+
+	for fileName, contents := range files {
+		err = writeFileSync(filepath.Join(stagingDir, fileName), contents, 0600)
+		if err != nil {
+			os.RemoveAll(stagingDir)
+			return err
+		}
+	}
+
+	err = os.Rename(stagingDir, filepath.Join(root, name))
+	if err != nil {
+		os.RemoveAll(stagingDir)
+		return err
+	}
+	return nil
+}
+
+// isImportable reports whether a bundle may contain a file, which is only the case for nebula configs, PKI files and
+// the tunnel metadata.
+func isImportable(name string) bool {
+	switch strings.ToLower(filepath.Ext(name)) {
+	case ".crt", ".key", ".pem":
+		return true
+	}
+	return isYAMLFile(name) || name == metadataFileName
+}
+
+// ImportTunnelBundle validates a .zip or .tar.gz tunnel bundle and unpacks it into a new tunnel directory under root,
+// which is one of roots. The bundle name is used as the tunnel name if name is empty, and is suffixed if a tunnel in
+// any of roots already uses it. The name of the created tunnel is returned.
+func ImportTunnelBundle(roots []ConfigRoot, root string, archivePath string, name string) (string, error) {
+	files, err := readBundle(archivePath)
+	if err != nil {
+		return "", err
+	}
+
+	var manifest *BundleManifest
+	if manifestBytes, ok := files[bundleManifestName]; ok {
+		manifest = &BundleManifest{}
+		err = json.Unmarshal(manifestBytes, manifest)
+		if err != nil {
+			return "", fmt.Errorf("invalid bundle manifest: %s", err)
+		}
+		delete(files, bundleManifestName)
+	}
+	for name := range files {
+		if !isImportable(name) {
+			return "", fmt.Errorf("bundle contains %s, which is not a nebula config, certificate, key or metadata.json", name)
+		}
+	}
+
+	for name, contents := range files {
+		if !isYAMLFile(name) {
+			continue
+		}
+		files[name], err = flattenPKIPaths(contents)
+		if err != nil {
+			return "", fmt.Errorf("%s is not valid YAML: %s", name, err)
+		}
+	}
+
+	err = validateBundle(files, manifest)
+	if err != nil {
+		return "", err
+	}
+
+	if name == "" {
+		name = bundleBaseName(archivePath)
+	}
+	tunnelName, err := uniqueTunnelName(roots, name)
+	if err != nil {
+		return "", err
+	}
+
+	err = writeTunnelDir(root, tunnelName, files)
+	if err != nil {
+		return "", err
+	}
+	return tunnelName, nil
+}
+
+// controllerArtifacts are generated per device on every controller login and are never exported.
+var controllerArtifacts = map[string]bool{
+	"zz_controller_config.yml": true,
+	"node_controller.yml":      true,
+	"node.key":                 true,
+	"node.pub":                 true,
+	"node.crt":                 true,
+}
+
+func isExportable(name string, contents []byte, includeKey bool) bool {
+	if controllerArtifacts[name] || name == statusFileName || name == bundleManifestName {
+		return false
+	}
+	ext := strings.ToLower(filepath.Ext(name))
+	switch {
+	case ext == ".key", (ext == ".crt" || ext == ".pem") && isPrivateKeyPEM(contents):
+		return includeKey
+	case isYAMLFile(name), ext == ".crt", ext == ".pem", name == metadataFileName:
+		return true
+	}
+	return false
+}
+
+func isPrivateKeyPEM(contents []byte) bool {
+	return strings.Contains(string(contents), "PRIVATE KEY-----")
+}
+
+// pkiMapping returns the pki section of a parsed nebula config, or nil if it has none.
+func pkiMapping(doc *yaml.Node) *yaml.Node {
+	if len(doc.Content) == 0 || doc.Content[0].Kind != yaml.MappingNode {
+		return nil
+	}
+	root := doc.Content[0]
+	var pki *yaml.Node
+	for i := 0; i+1 < len(root.Content); i += 2 {
+		if root.Content[i].Value == "pki" && root.Content[i+1].Kind == yaml.MappingNode {
+			pki = root.Content[i+1]
+		}
+	}
+	return pki
+}
+
+func encodeYAML(doc *yaml.Node) ([]byte, error) {
+	var buf bytes.Buffer
+	enc := yaml.NewEncoder(&buf)
+	enc.SetIndent(2)
+	err := enc.Encode(doc)
+	if err != nil {
+		return nil, err
+	}
+	err = enc.Close()
+	if err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+// stripInlineKey removes a pki.key given as inline PEM from a nebula config, so it does not leave the machine in a
+// bundle exported without keys. Configs without one are returned unchanged.
+func stripInlineKey(contents []byte) ([]byte, error) {
+	var doc yaml.Node
+	err := yaml.Unmarshal(contents, &doc)
+	if err != nil {
+		return nil, err
+	}
+	pki := pkiMapping(&doc)
+	if pki == nil {
+		return contents, nil
+	}
+
+	stripped := false
+	for j := 0; j+1 < len(pki.Content); j += 2 {
+		if pki.Content[j].Value == "key" && strings.Contains(pki.Content[j+1].Value, "-----BEGIN") {
+			pki.Content = append(pki.Content[:j], pki.Content[j+2:]...)
+			stripped = true
+			break
+		}
+	}
+	if !stripped {
+		return contents, nil
+	}
+	return encodeYAML(&doc)
+}
+
+func writeZipBundle(w io.Writer, names []string, files map[string][]byte) error {
+	zw := zip.NewWriter(w)
+	for _, name := range names {
+		fw, err := zw.Create(name)
+		if err != nil {
+			return err
+		}
+		_, err = fw.Write(files[name])
+		if err != nil {
+			return err
+		}
+	}
+	return zw.Close()
+}
+
+func writeTarGzBundle(w io.Writer, names []string, files map[string][]byte) error {
+	gz := gzip.NewWriter(w)
+	tw := tar.NewWriter(gz)
+	for _, name := range names {
+		err := tw.WriteHeader(&tar.Header{
+			Name:    name,
+			Mode:    0600,
+			Size:    int64(len(files[name])),
+			ModTime: time.Now(),
+		})
+		if err != nil {
+			return err
+		}
+		_, err = tw.Write(files[name])
+		if err != nil {
+			return err
+		}
+	}
+	err := tw.Close()
+	if err != nil {
+		return err
+	}
+	return gz.Close()
+}
+
+// ExportTunnelBundle writes the shareable parts of a tunnel directory to a .zip or .tar.gz archive along with a
+// manifest. Private keys, including ones inlined in a config, are left out unless includeKey is set, controller
+// generated artifacts are always left out.
+func ExportTunnelBundle(tunnelPath string, archivePath string, includeKey bool) error {
+	lower := strings.ToLower(archivePath)
+	writeBundle := writeZipBundle
+	switch {
+	case strings.HasSuffix(lower, ".zip"):
+	case strings.HasSuffix(lower, ".tar.gz"), strings.HasSuffix(lower, ".tgz"):
+		writeBundle = writeTarGzBundle
+	default:
+		return errors.New("bundle must be a .zip or .tar.gz archive")
+	}
+
+	entries, err := ioutil.ReadDir(tunnelPath)
+	if err != nil {
+		return err
+	}
+
+	manifest := BundleManifest{
+		TunnelName:  filepath.Base(tunnelPath),
+		ExportedAt:  time.Now().UTC(),
+		KeyIncluded: includeKey,
+	}
+	files := make(map[string][]byte)
+	for _, e := range entries {
+		if !e.Mode().IsRegular() {
+			continue
+		}
+		contents, err := ioutil.ReadFile(filepath.Join(tunnelPath, e.Name()))
+		if err != nil {
+			return err
+		}
+		if !isExportable(e.Name(), contents, includeKey) {
+			continue
+		}
+		if !includeKey && isYAMLFile(e.Name()) {
+			contents, err = stripInlineKey(contents)
+			if err != nil {
+				return fmt.Errorf("%s is not valid YAML: %s", e.Name(), err)
+			}
+		}
+		files[e.Name()] = contents
+		manifest.Files = append(manifest.Files, e.Name())
+	}
+	sort.Strings(manifest.Files)
+
+	manifestBytes, err := json.MarshalIndent(manifest, "", "  ")
+	if err != nil {
+		return err
+	}
+	files[bundleManifestName] = manifestBytes
+	names := append([]string{bundleManifestName}, manifest.Files...)
+
+	out, err := os.OpenFile(archivePath, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0600)
+	if err != nil {
+		return err
+	}
+	err = writeBundle(out, names, files)
+	if closeErr := out.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		os.Remove(archivePath)
+	}
+	return err
+}
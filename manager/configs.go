@@ -1,88 +1,180 @@
 package manager
 
 import (
-	"encoding/json"
+	"fmt"
 	"io/ioutil"
 	"log"
 	"os"
 	"path"
 	"path/filepath"
+	"strings"
 )
 
+// Tunnel is a tunnel directory. Name is its stable ID, used for the directory and the tunnel service, while
+// DisplayName comes from the tunnel's metadata and can change freely.
 type Tunnel struct {
-	Path  string
-	Name  string
-	State TunnelState
+	Path        string
+	Name        string
+	DisplayName string
+	State       TunnelState
+	Source      TunnelSource
+	ReadOnly    bool
 }
 
-type ConfigMetadata struct {
-	ControllerURL string `json:"controller_url,omitempty"`
-	TunnelName    string `json:"tunnel_name,omitempty"`
-	Fingerprint   string `json:"fingerprint,omitempty"`
+func (t *Tunnel) Title() string {
+	if t.DisplayName != "" {
+		return t.DisplayName
+	}
+	return t.Name
 }
 
-var CurrentTunnels []Tunnel
+func (t *Tunnel) String() string {
+	if t.DisplayName != "" && t.DisplayName != t.Name {
+		return fmt.Sprintf("%s (%s)", t.DisplayName, t.Name)
+	}
+	return t.Name
+}
 
-func LoadTunnelConfigs() {
+// TunnelDisplayName returns the display name from a tunnel's metadata, or an empty string if it has none.
+func TunnelDisplayName(configPath string) string {
+	md, err := LoadTunnelMetadata(configPath)
+	if err != nil || md == nil {
+		return ""
+	}
+	return strings.TrimSpace(md.TunnelName)
+}
+
+// SetTunnelDisplayName changes the display name of a tunnel without touching its directory or service.
+func SetTunnelDisplayName(configPath string, displayName string) error {
+	return UpdateTunnelMetadata(configPath, func(md *ConfigMetadata) error {
+		md.TunnelName = strings.TrimSpace(displayName)
+		return nil
+	})
+}
+
+func NebulaConfigDir() string {
 	configDir, _ := os.UserConfigDir()
-	nebulaConfigDir := path.Join(configDir, "Nebula")
-	log.Printf("Nebula Config dir is %s", nebulaConfigDir)
-	if _, err := os.Stat(nebulaConfigDir); os.IsNotExist(err) {
-		err := os.MkdirAll(nebulaConfigDir, 0600)
+	return path.Join(configDir, "Nebula")
+}
 
-		if err != nil {
-			log.Printf("Couldnt create config dir, no tunnels will be available")
+func loadTunnelsFromRoot(root ConfigRoot) []Tunnel {
+	log.Printf("Nebula %s config dir is %s", root.Source, root.Path)
+	if root.Source != MachineTunnelSource {
+		if _, err := os.Stat(root.Path); os.IsNotExist(err) {
+			err := os.MkdirAll(root.Path, 0600)
+
+			if err != nil {
+				log.Printf("Couldnt create config dir, no tunnels will be available")
+			}
 		}
 	}
 
-	files, err := ioutil.ReadDir(nebulaConfigDir)
+	files, err := ioutil.ReadDir(root.Path)
 	if err != nil {
-		log.Fatalf("Error getting directory listing in %s: %s", nebulaConfigDir, err)
+		log.Printf("Error getting directory listing in %s: %s", root.Path, err)
+		return nil
 	}
 
+	var tunnels []Tunnel
 	for _, f := range files {
-		if f.IsDir() {
+		if f.IsDir() && !strings.HasPrefix(f.Name(), ".") {
 			log.Printf("Checking %s\n", f.Name())
-			alreadyExists := false
-
-			for _, t := range CurrentTunnels {
-				if t.Name == f.Name() {
-					alreadyExists = true
-					break
+			if root.Source != MachineTunnelSource {
+				migrated, err := MigrateTunnelMetadata(path.Join(root.Path, f.Name()))
+				if err != nil {
+					log.Printf("Metadata of %s could not be migrated: %s", f.Name(), err)
+				} else if migrated {
+					log.Printf("Migrated metadata of %s to version %d", f.Name(), CurrentMetadataVersion)
 				}
 			}
+			tunnelPath := path.Join(root.Path, f.Name())
+			tunnels = append(tunnels, Tunnel{
+				Path:        tunnelPath,
+				Name:        f.Name(),
+				DisplayName: TunnelDisplayName(tunnelPath),
+				State:       TunnelStopped,
+				Source:      root.Source,
+				ReadOnly:    root.Source == MachineTunnelSource && !IsAdmin,
+			})
+		}
+	}
+	return tunnels
+}
 
-			if alreadyExists {
+// loadAllTunnels lists the tunnels of every config root. A tunnel name can only be used once since it also names
+// the tunnel service, so earlier roots win.
+func loadAllTunnels() []Tunnel {
+	var tunnels []Tunnel
+	seen := make(map[string]string)
+
+	for _, root := range ConfigRoots() {
+		for _, t := range loadTunnelsFromRoot(root) {
+			if existing, ok := seen[t.Name]; ok {
+				log.Printf("Ignoring %s, tunnel %s is already provided by %s", t.Path, t.Name, existing)
 				continue
 			}
+			seen[t.Name] = t.Path
+			tunnels = append(tunnels, t)
+		}
+	}
+	return tunnels
+}
 
-			newTun := Tunnel{
-				Path:  path.Join(nebulaConfigDir, f.Name()),
-				Name:  f.Name(),
-				State: TunnelStopped,
-			}
-			CurrentTunnels = append(CurrentTunnels, newTun)
+// LoadTunnelConfigs registers every configured tunnel that is not known yet.
+func LoadTunnelConfigs() {
+	for _, t := range loadAllTunnels() {
+		if _, ok := Tunnels.Get(t.Name); ok {
+			continue
 		}
+		Tunnels.Add(t)
 	}
+}
 
+// ReloadTunnelConfigs replaces Tunnels with the tunnel directories found in every config root.
+func ReloadTunnelConfigs() {
+	Tunnels.Replace(loadAllTunnels())
 }
 
-func LoadTunnelMetadata(configPath string) *ConfigMetadata {
+// WatchTunnelConfigs calls onModified for tunnels whose config files were edited so that a reload can be offered.
+// Tunnels being added, removed or renamed are reported by the manager service, see WatchTunnelRoot.
+func WatchTunnelConfigs(onModified func(tunnelName string)) (ConfigWatchers, error) {
+	var watchers ConfigWatchers
 
-	metadataPath := filepath.Join(configPath, "metadata.json")
-	metadataRaw, err := ioutil.ReadFile(metadataPath)
+	for _, root := range ConfigRoots() {
+		w, err := NewConfigWatcher(root.Path, func(diff TunnelsDiff) {
+			for _, name := range diff.Modified {
+				onModified(name)
+			}
+		})
+		if err != nil {
+			watchers.Stop()
+			return nil, err
+		}
 
-	if err != nil {
-		return nil
+		w.Start()
+		watchers = append(watchers, w)
 	}
+	return watchers, nil
+}
 
-	var metaData ConfigMetadata
-
-	err = json.Unmarshal(metadataRaw, &metaData)
-
+// WatchTunnelRoot calls notify when tunnels are added to, removed from or renamed in a config root.
+func WatchTunnelRoot(root string, notify func()) (*ConfigWatcher, error) {
+	w, err := NewConfigWatcher(root, func(diff TunnelsDiff) {
+		if diff.TunnelsChanged() {
+			notify()
+		}
+	})
 	if err != nil {
-		return nil
+		return nil, err
 	}
+	w.Start()
+	return w, nil
+}
 
-	return &metaData
+// TunnelPath returns the directory of a tunnel under root, refusing names that would point outside of it.
+func TunnelPath(root string, tunnelName string) (string, error) {
+	if tunnelName == "" || tunnelName != filepath.Base(tunnelName) || strings.HasPrefix(tunnelName, ".") {
+		return "", fmt.Errorf("invalid tunnel name %q", tunnelName)
+	}
+	return filepath.Join(root, tunnelName), nil
 }
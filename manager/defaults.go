@@ -0,0 +1,131 @@
+package manager
+
+import (
+	"bytes"
+	"crypto/sha256"
+	_ "embed"
+	"encoding/hex"
+	"fmt"
+	"gopkg.in/yaml.v2"
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+)
+
+const (
+	DefaultConfigFileName = "default.yml"
+	// A replaced default.yml that was changed by hand is kept under a name nebula does not load
+	modifiedDefaultConfigSuffix = ".modified"
+)
+
+//go:embed default.yml
+var embeddedDefaultConfig []byte
+
+// DefaultConfigModifiedError is returned when the default.yml of a tunnel was changed since it was last applied and
+// would be lost by updating it.
+type DefaultConfigModifiedError struct {
+	Path string
+}
+
+func (e *DefaultConfigModifiedError) Error() string {
+	return fmt.Sprintf("%s was changed by hand, move the changes to overrides.yml or force the update", e.Path)
+}
+
+// DefaultConfig returns the default node config tunnels start from and where it came from: default.yml in the machine
+// config root if an administrator put one there, otherwise the one built into the UI.
+func DefaultConfig() ([]byte, string, error) {
+	overridePath := filepath.Join(MachineConfigDir(), DefaultConfigFileName)
+	override, err := ioutil.ReadFile(overridePath)
+	if os.IsNotExist(err) {
+		return embeddedDefaultConfig, "built-in", nil
+	}
+	if err != nil {
+		return nil, "", err
+	}
+
+	var parsed map[string]interface{}
+	if err := yaml.Unmarshal(override, &parsed); err != nil {
+		return nil, "", fmt.Errorf("invalid %s: %s", overridePath, err)
+	}
+	return override, overridePath, nil
+}
+
+func defaultConfigHash(b []byte) string {
+	sum := sha256.Sum256(b)
+	return hex.EncodeToString(sum[:])
+}
+
+// StageDefaultConfig adds the default node config to a transaction for the tunnel directory of tx. A default.yml that
+// was changed since it was last applied is only replaced if force is set, and then kept as default.yml.modified. It
+// returns the hash to record with RecordDefaultConfig once the transaction is committed.
+func StageDefaultConfig(tx *ArtifactTransaction, md *ConfigMetadata, force bool) (string, error) {
+	defaultConfig, source, err := DefaultConfig()
+	if err != nil {
+		return "", err
+	}
+	hash := defaultConfigHash(defaultConfig)
+
+	currentPath := filepath.Join(tx.dir, DefaultConfigFileName)
+	current, err := ioutil.ReadFile(currentPath)
+	if err != nil && !os.IsNotExist(err) {
+		return "", err
+	}
+	if err == nil && !bytes.Equal(current, defaultConfig) {
+		applied := ""
+		if md != nil {
+			applied = md.DefaultConfig
+		}
+		if applied != defaultConfigHash(current) {
+			if !force {
+				return "", &DefaultConfigModifiedError{Path: currentPath}
+			}
+			tx.Put(DefaultConfigFileName+modifiedDefaultConfigSuffix, current)
+		}
+	}
+
+	tx.Put(DefaultConfigFileName, defaultConfig)
+	log.Printf("Staged the %s default config for %s\n", source, tx.dir)
+	return hash, nil
+}
+
+// RecordDefaultConfig remembers which default config a tunnel got, so later updates can tell whether it was changed.
+func RecordDefaultConfig(tunnelPath string, hash string) error {
+	return UpdateTunnelMetadata(tunnelPath, func(md *ConfigMetadata) error {
+		md.DefaultConfig = hash
+		return nil
+	})
+}
+
+// UpdateDefaultConfig applies the current default node config to a tunnel. It reports whether default.yml changed.
+func UpdateDefaultConfig(tunnelPath string, force bool) (bool, error) {
+	md, err := LoadTunnelMetadata(tunnelPath)
+	if err != nil {
+		return false, err
+	}
+
+	tx := NewArtifactTransaction(tunnelPath)
+	hash, err := StageDefaultConfig(tx, md, force)
+	if err != nil {
+		return false, err
+	}
+	changed := tx.Len() > 0
+	err = tx.Commit()
+	if err != nil {
+		return false, err
+	}
+	if md == nil || md.DefaultConfig != hash {
+		err = RecordDefaultConfig(tunnelPath, hash)
+	}
+	return changed, err
+}
+
+// UsesDefaultConfig reports whether a tunnel is built on the default node config: controller managed tunnels always
+// are, others if they have a default.yml.
+func UsesDefaultConfig(tunnelPath string) bool {
+	if _, err := os.Stat(filepath.Join(tunnelPath, DefaultConfigFileName)); err == nil {
+		return true
+	}
+	md, err := LoadTunnelMetadata(tunnelPath)
+	return err == nil && md != nil && md.ControllerURL != ""
+}
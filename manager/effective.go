@@ -0,0 +1,256 @@
+package manager
+
+import (
+	"bytes"
+	"fmt"
+	"github.com/sirupsen/logrus"
+	"github.com/slackhq/nebula"
+	"gopkg.in/yaml.v2"
+	yamlv3 "gopkg.in/yaml.v3"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"sort"
+	"strings"
+)
+
+const redactedValue = "<redacted>"
+
+// Keys whose values are always secret, regardless of their content.
+var secretKeyWords = []string{"password", "secret", "token", "passphrase"}
+
+type configSource struct {
+	name     string
+	settings map[interface{}]interface{}
+}
+
+// EffectiveConfig renders the config nebula runs a tunnel with: every YAML file in the tunnel directory merged the
+// way nebula merges them. Each value is annotated with the file that set it and secrets are redacted.
+func EffectiveConfig(tunnelPath string) (string, error) {
+	l := logrus.New()
+	l.Out = ioutil.Discard
+
+	config := nebula.NewConfig(l)
+	err := config.Load(tunnelPath)
+	if err != nil {
+		return "", err
+	}
+
+	sources, err := loadConfigSources(tunnelPath)
+	if err != nil {
+		return "", err
+	}
+
+	doc := effectiveNode(config.Settings, nil, sources)
+	var names []string
+	for _, s := range sources {
+		names = append(names, s.name)
+	}
+	doc.HeadComment = fmt.Sprintf("Effective config of %s, merged from %s", filepath.Base(tunnelPath), strings.Join(names, ", "))
+
+	var out bytes.Buffer
+	encoder := yamlv3.NewEncoder(&out)
+	encoder.SetIndent(2)
+	err = encoder.Encode(doc)
+	if err != nil {
+		return "", err
+	}
+	encoder.Close()
+	return out.String(), nil
+}
+
+// loadConfigSources reads the files nebula would load from tunnelPath, in the order it merges them.
+func loadConfigSources(tunnelPath string) ([]configSource, error) {
+	var files []string
+	err := filepath.Walk(tunnelPath, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			return nil
+		}
+		ext := filepath.Ext(path)
+		if !info.IsDir() && (ext == ".yml" || ext == ".yaml") {
+			files = append(files, path)
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	sort.Strings(files)
+
+	var sources []configSource
+	for _, path := range files {
+		b, err := ioutil.ReadFile(path)
+		if err != nil {
+			return nil, err
+		}
+		var settings map[interface{}]interface{}
+		err = yaml.Unmarshal(b, &settings)
+		if err != nil {
+			return nil, fmt.Errorf("%s: %s", path, err)
+		}
+		name, err := filepath.Rel(tunnelPath, path)
+		if err != nil {
+			name = filepath.Base(path)
+		}
+		sources = append(sources, configSource{name: name, settings: settings})
+	}
+	return sources, nil
+}
+
+// lookup returns the value at path in a source, if the source sets it.
+func (s *configSource) lookup(path []string) (interface{}, bool) {
+	var v interface{} = s.settings
+	for _, k := range path {
+		m, ok := v.(map[interface{}]interface{})
+		if !ok {
+			return nil, false
+		}
+		v, ok = m[k]
+		if !ok {
+			return nil, false
+		}
+	}
+	return v, true
+}
+
+// valueSource returns the last file that sets path to value. Merging only fills in values a later file left empty,
+// so the last file with an equal value is the one that won.
+func valueSource(path []string, value interface{}, sources []configSource) string {
+	fallback := ""
+	for i := len(sources) - 1; i >= 0; i-- {
+		v, ok := sources[i].lookup(path)
+		if !ok {
+			continue
+		}
+		if reflect.DeepEqual(v, value) {
+			return sources[i].name
+		}
+		if fallback == "" {
+			fallback = sources[i].name
+		}
+	}
+	return fallback
+}
+
+// elementSource returns the file that contributed an element of the list at path.
+func elementSource(path []string, element interface{}, sources []configSource) string {
+	for i := len(sources) - 1; i >= 0; i-- {
+		v, ok := sources[i].lookup(path)
+		if !ok {
+			continue
+		}
+		list, ok := v.([]interface{})
+		if !ok {
+			continue
+		}
+		for _, e := range list {
+			if reflect.DeepEqual(e, element) {
+				return sources[i].name
+			}
+		}
+	}
+	return ""
+}
+
+func listSources(path []string, sources []configSource) string {
+	var names []string
+	for _, s := range sources {
+		if _, ok := s.lookup(path); ok {
+			names = append(names, s.name)
+		}
+	}
+	return strings.Join(names, ", ")
+}
+
+func isSecretKey(key string) bool {
+	key = strings.ToLower(key)
+	for _, word := range secretKeyWords {
+		if strings.Contains(key, word) {
+			return true
+		}
+	}
+	return false
+}
+
+func redact(path []string, value interface{}) interface{} {
+	if len(path) > 0 && isSecretKey(path[len(path)-1]) {
+		return redactedValue
+	}
+	if s, ok := value.(string); ok && strings.Contains(s, "PRIVATE KEY") {
+		return redactedValue
+	}
+	return value
+}
+
+func scalarNode(value interface{}) *yamlv3.Node {
+	var doc yamlv3.Node
+	b, err := yamlv3.Marshal(value)
+	if err == nil {
+		err = yamlv3.Unmarshal(b, &doc)
+	}
+	if err != nil || len(doc.Content) == 0 {
+		return &yamlv3.Node{Kind: yamlv3.ScalarNode, Value: fmt.Sprint(value)}
+	}
+	return doc.Content[0]
+}
+
+// annotate attaches a source comment to a value, above it when the value spans several lines so the comment does not
+// end up inside a block scalar.
+func annotate(key *yamlv3.Node, value *yamlv3.Node, source string) {
+	if source == "" {
+		return
+	}
+	if value.Kind == yamlv3.ScalarNode && strings.Contains(value.Value, "\n") {
+		key.HeadComment = source
+		return
+	}
+	key.LineComment = source
+}
+
+func effectiveNode(value interface{}, path []string, sources []configSource) *yamlv3.Node {
+	m, ok := value.(map[interface{}]interface{})
+	if !ok {
+		return scalarNode(value)
+	}
+
+	keys := make([]string, 0, len(m))
+	byName := make(map[string]interface{}, len(m))
+	for k, v := range m {
+		name := fmt.Sprint(k)
+		keys = append(keys, name)
+		byName[name] = v
+	}
+	sort.Strings(keys)
+
+	n := &yamlv3.Node{Kind: yamlv3.MappingNode}
+	for _, k := range keys {
+		v := byName[k]
+		childPath := append(append([]string(nil), path...), k)
+		keyNode := &yamlv3.Node{Kind: yamlv3.ScalarNode, Value: k}
+
+		var valueNode *yamlv3.Node
+		switch child := v.(type) {
+		case map[interface{}]interface{}:
+			valueNode = effectiveNode(child, childPath, sources)
+		case []interface{}:
+			valueNode = &yamlv3.Node{Kind: yamlv3.SequenceNode}
+			for _, e := range child {
+				elementNode := effectiveNode(redact(childPath, e), childPath, sources)
+				source := elementSource(childPath, e, sources)
+				if elementNode.Kind == yamlv3.ScalarNode && !strings.Contains(elementNode.Value, "\n") {
+					elementNode.LineComment = source
+				} else {
+					elementNode.HeadComment = source
+				}
+				valueNode.Content = append(valueNode.Content, elementNode)
+			}
+			keyNode.LineComment = listSources(childPath, sources)
+		default:
+			valueNode = scalarNode(redact(childPath, v))
+			annotate(keyNode, valueNode, valueSource(childPath, v, sources))
+		}
+		n.Content = append(n.Content, keyNode, valueNode)
+	}
+	return n
+}
@@ -0,0 +1,157 @@
+package manager
+
+import (
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/url"
+	"os"
+	"strings"
+)
+
+// Enrollment links look like
+//
+//	nebula://enroll?controller=https%3A%2F%2Fcontroller.example.com&name=Example%20Corp&fingerprint=ab12...
+//
+// controller is the https URL of the controller, name the tunnel name and fingerprint the hex encoded SHA-256 of the
+// subject public key info the controller's TLS key is pinned to. Colons between the hex bytes and a "sha256:" prefix
+// are accepted. Links without a fingerprint pin the key the controller presents at enrollment.
+const (
+	EnrollScheme     = "nebula"
+	enrollAction     = "enroll"
+	maxEnrollLinkLen = 2048
+)
+
+type EnrollLink struct {
+	ControllerURL string
+	TunnelName    string
+	Fingerprint   string
+}
+
+// NormalizeFingerprint returns a SHA-256 fingerprint as lowercase hex without separators.
+func NormalizeFingerprint(fingerprint string) (string, error) {
+	fp := strings.ToLower(strings.TrimSpace(fingerprint))
+	fp = strings.TrimPrefix(fp, "sha256:")
+	fp = strings.Replace(fp, ":", "", -1)
+	b, err := hex.DecodeString(fp)
+	if err != nil || len(b) != 32 {
+		return "", errors.New("fingerprint must be a hex encoded SHA-256 hash")
+	}
+	return fp, nil
+}
+
+func singleQueryValue(query url.Values, key string) (string, error) {
+	values := query[key]
+	if len(values) > 1 {
+		return "", fmt.Errorf("%s is given more than once", key)
+	}
+	if len(values) == 0 || strings.TrimSpace(values[0]) == "" {
+		return "", fmt.Errorf("%s is missing", key)
+	}
+	return strings.TrimSpace(values[0]), nil
+}
+
+// ParseEnrollLink parses and validates a nebula://enroll link.
+func ParseEnrollLink(raw string) (*EnrollLink, error) {
+	if len(raw) > maxEnrollLinkLen {
+		return nil, errors.New("enrollment link is too long")
+	}
+	u, err := url.Parse(strings.TrimSpace(raw))
+	if err != nil {
+		return nil, fmt.Errorf("invalid enrollment link: %s", err)
+	}
+	if !strings.EqualFold(u.Scheme, EnrollScheme) {
+		return nil, fmt.Errorf("enrollment links must start with %s://", EnrollScheme)
+	}
+	// Browsers hand over nebula://enroll/?... as well as nebula://enroll?...
+	action := u.Host
+	if action == "" {
+		action = u.Opaque
+	}
+	if !strings.EqualFold(action, enrollAction) || (u.Path != "" && u.Path != "/") {
+		return nil, fmt.Errorf("unsupported link %s://%s%s", u.Scheme, action, u.Path)
+	}
+
+	query, err := url.ParseQuery(u.RawQuery)
+	if err != nil {
+		return nil, fmt.Errorf("invalid enrollment link: %s", err)
+	}
+
+	link := &EnrollLink{}
+	var problems []string
+	if link.ControllerURL, err = singleQueryValue(query, "controller"); err != nil {
+		problems = append(problems, err.Error())
+	} else {
+		controller, err := url.Parse(link.ControllerURL)
+		if err != nil || controller.Scheme != "https" || controller.Host == "" {
+			problems = append(problems, "controller must be an https URL")
+		} else if controller.User != nil || controller.RawQuery != "" || controller.Fragment != "" {
+			problems = append(problems, "controller must not carry credentials, a query or a fragment")
+		} else {
+			link.ControllerURL = strings.TrimRight(controller.String(), "/")
+		}
+	}
+	if link.TunnelName, err = singleQueryValue(query, "name"); err != nil {
+		problems = append(problems, err.Error())
+	} else if SanitizeTunnelName(link.TunnelName) == "" {
+		problems = append(problems, "name must contain letters or digits")
+	} else if strings.ContainsAny(link.TunnelName, "\r\n\t") {
+		problems = append(problems, "name must be a single line")
+	}
+	if _, ok := query["fingerprint"]; ok {
+		if fingerprint, err := singleQueryValue(query, "fingerprint"); err != nil {
+			problems = append(problems, err.Error())
+		} else if link.Fingerprint, err = NormalizeFingerprint(fingerprint); err != nil {
+			problems = append(problems, err.Error())
+		}
+	}
+
+	if len(problems) > 0 {
+		return nil, fmt.Errorf("invalid enrollment link: %s", strings.Join(problems, "; "))
+	}
+	return link, nil
+}
+
+// DirName is the name of the tunnel directory created for the link.
+func (l *EnrollLink) DirName() string {
+	return SanitizeTunnelName(l.TunnelName)
+}
+
+// EnrollTunnel creates a controller managed tunnel under root from an enrollment link, pinned to the Nebula CAs the
+// controller handed out at enrollment. The tunnel only holds its metadata until the first activation fetches the
+// config from the controller.
+func EnrollTunnel(root string, link *EnrollLink, caFingerprints []string) (string, error) {
+	tunnelName := link.DirName()
+	tunnelPath, err := TunnelPath(root, tunnelName)
+	if err != nil {
+		return "", err
+	}
+	if _, err := os.Stat(tunnelPath); err == nil {
+		return "", fmt.Errorf("tunnel %s already exists", tunnelName)
+	}
+
+	md := &ConfigMetadata{
+		Version:        CurrentMetadataVersion,
+		ControllerURL:  link.ControllerURL,
+		Fingerprint:    link.Fingerprint,
+		CAFingerprints: caFingerprints,
+		SessionPolicy:  SessionPolicyStopOnLogoff,
+	}
+	if link.TunnelName != tunnelName {
+		md.TunnelName = link.TunnelName
+	}
+	if problems := md.Validate(); len(problems) > 0 {
+		return "", &MetadataError{Path: metadataFileName, Problems: problems}
+	}
+	metadataBytes, err := json.MarshalIndent(md, "", "  ")
+	if err != nil {
+		return "", err
+	}
+
+	err = writeTunnelDir(root, tunnelName, map[string][]byte{metadataFileName: metadataBytes})
+	if err != nil {
+		return "", err
+	}
+	return tunnelName, nil
+}
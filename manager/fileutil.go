@@ -0,0 +1,41 @@
+package manager
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+)
+
+func writeFileSync(fileName string, contents []byte, perm os.FileMode) error {
+	f, err := os.OpenFile(fileName, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, perm)
+	if err != nil {
+		return err
+	}
+	_, err = f.Write(contents)
+	if err == nil {
+		err = f.Sync()
+	}
+	if closeErr := f.Close(); err == nil {
+		err = closeErr
+	}
+	return err
+}
+
+// writeFileAtomic replaces fileName with contents so readers only ever see the old or the new file.
+func writeFileAtomic(fileName string, contents []byte, perm os.FileMode) error {
+	tmp, err := ioutil.TempFile(filepath.Dir(fileName), "."+filepath.Base(fileName)+".tmp")
+	if err != nil {
+		return err
+	}
+	tmpName := tmp.Name()
+	tmp.Close()
+
+	err = writeFileSync(tmpName, contents, perm)
+	if err == nil {
+		err = os.Rename(tmpName, fileName)
+	}
+	if err != nil {
+		os.Remove(tmpName)
+	}
+	return err
+}
@@ -0,0 +1,211 @@
+package manager
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"github.com/sirupsen/logrus"
+	"golang.org/x/sys/windows"
+	"net"
+	"sync"
+	"time"
+	"unsafe"
+)
+
+const (
+	defaultHealthCheckInterval  = 30 * time.Second
+	defaultHealthCheckThreshold = 3
+	healthCheckTimeout          = 2 * time.Second
+	healthHistorySize           = 20
+)
+
+var (
+	modiphlpapi         = windows.NewLazySystemDLL("iphlpapi.dll")
+	procIcmpCreateFile  = modiphlpapi.NewProc("IcmpCreateFile")
+	procIcmpCloseHandle = modiphlpapi.NewProc("IcmpCloseHandle")
+	procIcmpSendEcho    = modiphlpapi.NewProc("IcmpSendEcho")
+)
+
+type icmpEchoReply struct {
+	Address       uint32
+	Status        uint32
+	RoundTripTime uint32
+	DataSize      uint16
+	Reserved      uint16
+	Data          uintptr
+	Ttl           uint8
+	Tos           uint8
+	Flags         uint8
+	OptionsSize   uint8
+	OptionsData   uintptr
+}
+
+type HealthCheckResult struct {
+	Target              string          `json:"target"`
+	Healthy             bool            `json:"healthy"`
+	ConsecutiveFailures int             `json:"consecutive_failures"`
+	LastError           string          `json:"last_error,omitempty"`
+	LastChecked         time.Time       `json:"last_checked"`
+	Latencies           []time.Duration `json:"latencies"`
+}
+
+// pingOverlay sends a single ICMP echo to an overlay address and returns the round trip time.
+func pingOverlay(ip net.IP, timeout time.Duration) (time.Duration, error) {
+	ip4 := ip.To4()
+	if ip4 == nil {
+		return 0, fmt.Errorf("%s is not an IPv4 address", ip)
+	}
+
+	handle, _, err := procIcmpCreateFile.Call()
+	if windows.Handle(handle) == windows.InvalidHandle {
+		return 0, err
+	}
+	defer procIcmpCloseHandle.Call(handle)
+
+	payload := []byte("nebula-health")
+	reply := make([]byte, unsafe.Sizeof(icmpEchoReply{})+uintptr(len(payload))+8)
+
+	n, _, err := procIcmpSendEcho.Call(
+		handle,
+		uintptr(binary.LittleEndian.Uint32(ip4)),
+		uintptr(unsafe.Pointer(&payload[0])),
+		uintptr(len(payload)),
+		0,
+		uintptr(unsafe.Pointer(&reply[0])),
+		uintptr(len(reply)),
+		uintptr(timeout.Milliseconds()),
+	)
+	if n == 0 {
+		return 0, fmt.Errorf("no echo reply from %s: %v", ip, err)
+	}
+
+	echo := (*icmpEchoReply)(unsafe.Pointer(&reply[0]))
+	if echo.Status != 0 {
+		return 0, fmt.Errorf("echo to %s failed with status %d", ip, echo.Status)
+	}
+	return time.Duration(echo.RoundTripTime) * time.Millisecond, nil
+}
+
+// probeTarget checks a single health check target. Bare addresses are pinged, host:port targets are checked with a
+// TCP connect.
+func probeTarget(target string) (time.Duration, error) {
+	if _, _, err := net.SplitHostPort(target); err == nil {
+		start := time.Now()
+		conn, err := net.DialTimeout("tcp", target, healthCheckTimeout)
+		if err != nil {
+			return 0, err
+		}
+		conn.Close()
+		return time.Since(start), nil
+	}
+
+	ip := net.ParseIP(target)
+	if ip == nil {
+		return 0, errors.New("invalid health check target")
+	}
+	return pingOverlay(ip, healthCheckTimeout)
+}
+
+type healthChecker struct {
+	interval  time.Duration
+	threshold int
+	l         *logrus.Logger
+
+	lock    sync.Mutex
+	results []HealthCheckResult
+}
+
+func newHealthChecker(config *HealthCheckConfig, l *logrus.Logger) *healthChecker {
+	if config == nil || len(config.Targets) == 0 {
+		return nil
+	}
+
+	hc := &healthChecker{
+		interval:  defaultHealthCheckInterval,
+		threshold: defaultHealthCheckThreshold,
+		l:         l,
+	}
+	if config.IntervalSeconds > 0 {
+		hc.interval = time.Duration(config.IntervalSeconds) * time.Second
+	}
+	if config.FailureThreshold > 0 {
+		hc.threshold = config.FailureThreshold
+	}
+	for _, target := range config.Targets {
+		hc.results = append(hc.results, HealthCheckResult{Target: target, Healthy: true})
+	}
+	return hc
+}
+
+func (hc *healthChecker) checkAll() {
+	for i := range hc.results {
+		hc.lock.Lock()
+		target := hc.results[i].Target
+		hc.lock.Unlock()
+
+		latency, err := probeTarget(target)
+
+		hc.lock.Lock()
+		r := &hc.results[i]
+		r.LastChecked = time.Now()
+		if err != nil {
+			r.ConsecutiveFailures++
+			r.LastError = err.Error()
+			if r.Healthy && r.ConsecutiveFailures >= hc.threshold {
+				hc.l.Printf("health check %s failed %d times: %s\n", target, r.ConsecutiveFailures, err)
+				r.Healthy = false
+			}
+		} else {
+			if !r.Healthy {
+				hc.l.Printf("health check %s recovered\n", target)
+			}
+			r.ConsecutiveFailures = 0
+			r.LastError = ""
+			r.Healthy = true
+			r.Latencies = append(r.Latencies, latency)
+			if len(r.Latencies) > healthHistorySize {
+				r.Latencies = r.Latencies[len(r.Latencies)-healthHistorySize:]
+			}
+		}
+		hc.lock.Unlock()
+	}
+}
+
+func (hc *healthChecker) run(stop <-chan struct{}) {
+	ticker := time.NewTicker(hc.interval)
+	defer ticker.Stop()
+
+	for {
+		hc.checkAll()
+		select {
+		case <-stop:
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+func (hc *healthChecker) Results() []HealthCheckResult {
+	hc.lock.Lock()
+	defer hc.lock.Unlock()
+
+	results := make([]HealthCheckResult, len(hc.results))
+	for i, r := range hc.results {
+		results[i] = r
+		results[i].Latencies = append([]time.Duration(nil), r.Latencies...)
+	}
+	return results
+}
+
+// Failing returns the first unhealthy target, if any.
+func (hc *healthChecker) Failing() (string, bool) {
+	hc.lock.Lock()
+	defer hc.lock.Unlock()
+
+	for _, r := range hc.results {
+		if !r.Healthy {
+			return r.Target, true
+		}
+	}
+	return "", false
+}
@@ -62,6 +62,12 @@ func rpcDecodeError() error {
 	return errors.New(str)
 }
 
+func dispatchTunnelsChange() {
+	for cb := range tunnelsChangeCallbacks {
+		cb.cb()
+	}
+}
+
 func InitializeIPCClient(reader *os.File, writer *os.File, events *os.File) {
 	rpcDecoder = gob.NewDecoder(reader)
 	rpcEncoder = gob.NewEncoder(writer)
@@ -107,9 +113,7 @@ func InitializeIPCClient(reader *os.File, writer *os.File, events *os.File) {
 					cb.cb(tunnel, state, globalState, retErr)
 				}
 			case TunnelsChangeNotificationType:
-				for cb := range tunnelsChangeCallbacks {
-					cb.cb()
-				}
+				dispatchTunnelsChange()
 			case ManagerStoppingNotificationType:
 				for cb := range managerStoppingCallbacks {
 					cb.cb()
@@ -128,7 +132,7 @@ func InitializeIPCClient(reader *os.File, writer *os.File, events *os.File) {
 					continue
 				}
 
-				log.Printf("   %s %s\n", tunnelState, tunnelState)
+				log.Printf("   %s %d\n", tunnelName, tunnelState)
 
 				existingTun := false
 				for _, ti := range tunnelInfo {
@@ -153,7 +157,7 @@ func InitializeIPCClient(reader *os.File, writer *os.File, events *os.File) {
 }
 
 func IPCClientTunnelList() []Tunnel {
-	return CurrentTunnels
+	return Tunnels.Snapshot()
 }
 
 func IPCClientQuit(stopTunnelsOnQuit bool) (alreadyQuit bool, err error) {
@@ -211,3 +215,249 @@ func IPCClientStopTunnel(tunnelName string) (err error) {
 	err = rpcDecodeError()
 	return
 }
+
+func IPCClientTunnelState(tunnelName string) (state TunnelState, err error) {
+	rpcMutex.Lock()
+	defer rpcMutex.Unlock()
+
+	err = rpcEncoder.Encode(StateMethodType)
+	if err != nil {
+		return
+	}
+	err = rpcEncoder.Encode(tunnelName)
+	if err != nil {
+		return
+	}
+	err = rpcDecoder.Decode(&state)
+	if err != nil {
+		return
+	}
+	err = rpcDecodeError()
+	return
+}
+
+func IPCClientTunnelHealth(tunnelName string) (health []HealthCheckResult, err error) {
+	rpcMutex.Lock()
+	defer rpcMutex.Unlock()
+
+	err = rpcEncoder.Encode(HealthMethodType)
+	if err != nil {
+		return
+	}
+	err = rpcEncoder.Encode(tunnelName)
+	if err != nil {
+		return
+	}
+	err = rpcDecoder.Decode(&health)
+	if err != nil {
+		return
+	}
+	err = rpcDecodeError()
+	return
+}
+
+func IPCClientEffectiveConfig(tunnelName string) (config string, err error) {
+	rpcMutex.Lock()
+	defer rpcMutex.Unlock()
+
+	err = rpcEncoder.Encode(EffectiveConfigMethodType)
+	if err != nil {
+		return
+	}
+	err = rpcEncoder.Encode(tunnelName)
+	if err != nil {
+		return
+	}
+	err = rpcDecoder.Decode(&config)
+	if err != nil {
+		return
+	}
+	err = rpcDecodeError()
+	return
+}
+
+func IPCClientImportTunnel(archivePath string, tunnelName string) (name string, err error) {
+	rpcMutex.Lock()
+	defer rpcMutex.Unlock()
+
+	err = rpcEncoder.Encode(ImportMethodType)
+	if err != nil {
+		return
+	}
+	err = rpcEncoder.Encode(archivePath)
+	if err != nil {
+		return
+	}
+	err = rpcEncoder.Encode(tunnelName)
+	if err != nil {
+		return
+	}
+	err = rpcDecoder.Decode(&name)
+	if err != nil {
+		return
+	}
+	err = rpcDecodeError()
+	return
+}
+
+func IPCClientNewTunnelFromTemplate(templateName string, tunnelName string, values map[string]string) (err error) {
+	rpcMutex.Lock()
+	defer rpcMutex.Unlock()
+
+	err = rpcEncoder.Encode(NewFromTemplateMethodType)
+	if err != nil {
+		return
+	}
+	err = rpcEncoder.Encode(templateName)
+	if err != nil {
+		return
+	}
+	err = rpcEncoder.Encode(tunnelName)
+	if err != nil {
+		return
+	}
+	err = rpcEncoder.Encode(values)
+	if err != nil {
+		return
+	}
+	err = rpcDecodeError()
+	return
+}
+
+func IPCClientDuplicateTunnel(tunnelName string, newName string) (err error) {
+	rpcMutex.Lock()
+	defer rpcMutex.Unlock()
+
+	err = rpcEncoder.Encode(DuplicateMethodType)
+	if err != nil {
+		return
+	}
+	err = rpcEncoder.Encode(tunnelName)
+	if err != nil {
+		return
+	}
+	err = rpcEncoder.Encode(newName)
+	if err != nil {
+		return
+	}
+	err = rpcDecodeError()
+	return
+}
+
+func IPCClientRenameTunnel(tunnelName string, newName string) (err error) {
+	rpcMutex.Lock()
+	defer rpcMutex.Unlock()
+
+	err = rpcEncoder.Encode(RenameMethodType)
+	if err != nil {
+		return
+	}
+	err = rpcEncoder.Encode(tunnelName)
+	if err != nil {
+		return
+	}
+	err = rpcEncoder.Encode(newName)
+	if err != nil {
+		return
+	}
+	err = rpcDecodeError()
+	return
+}
+
+func IPCClientDeleteTunnel(tunnelName string, archive bool) (archivePath string, err error) {
+	rpcMutex.Lock()
+	defer rpcMutex.Unlock()
+
+	err = rpcEncoder.Encode(DeleteMethodType)
+	if err != nil {
+		return
+	}
+	err = rpcEncoder.Encode(tunnelName)
+	if err != nil {
+		return
+	}
+	err = rpcEncoder.Encode(archive)
+	if err != nil {
+		return
+	}
+	err = rpcDecoder.Decode(&archivePath)
+	if err != nil {
+		return
+	}
+	err = rpcDecodeError()
+	return
+}
+
+func IPCClientExportTunnel(tunnelName string, archivePath string, includeKey bool) (err error) {
+	rpcMutex.Lock()
+	defer rpcMutex.Unlock()
+
+	err = rpcEncoder.Encode(ExportMethodType)
+	if err != nil {
+		return
+	}
+	err = rpcEncoder.Encode(tunnelName)
+	if err != nil {
+		return
+	}
+	err = rpcEncoder.Encode(archivePath)
+	if err != nil {
+		return
+	}
+	err = rpcEncoder.Encode(includeKey)
+	if err != nil {
+		return
+	}
+	err = rpcDecodeError()
+	return
+}
+
+func IPCClientSetTunnelDisplayName(tunnelName string, displayName string) (err error) {
+	rpcMutex.Lock()
+	defer rpcMutex.Unlock()
+
+	err = rpcEncoder.Encode(SetDisplayNameMethodType)
+	if err != nil {
+		return
+	}
+	err = rpcEncoder.Encode(tunnelName)
+	if err != nil {
+		return
+	}
+	err = rpcEncoder.Encode(displayName)
+	if err != nil {
+		return
+	}
+	err = rpcDecodeError()
+	return
+}
+
+func IPCClientRegisterTunnelChange(cb func(tunnelName string, state TunnelState, globalState TunnelState, err error)) *TunnelChangeCallback {
+	s := &TunnelChangeCallback{cb}
+	tunnelChangeCallbacks[s] = true
+	return s
+}
+
+func (cb *TunnelChangeCallback) Unregister() {
+	delete(tunnelChangeCallbacks, cb)
+}
+
+func IPCClientRegisterTunnelsChange(cb func()) *TunnelsChangeCallback {
+	s := &TunnelsChangeCallback{cb}
+	tunnelsChangeCallbacks[s] = true
+	return s
+}
+
+func (cb *TunnelsChangeCallback) Unregister() {
+	delete(tunnelsChangeCallbacks, cb)
+}
+
+func IPCClientRegisterManagerStopping(cb func()) *ManagerStoppingCallback {
+	s := &ManagerStoppingCallback{cb}
+	managerStoppingCallbacks[s] = true
+	return s
+}
+
+func (cb *ManagerStoppingCallback) Unregister() {
+	delete(managerStoppingCallbacks, cb)
+}
@@ -1,14 +1,17 @@
 package manager
 
 import (
+	"bytes"
 	"encoding/gob"
 	"fmt"
 	"golang.org/x/sys/windows"
 	"io"
+	"log"
 	"os"
 	"path/filepath"
 	"sync"
 	"sync/atomic"
+	"time"
 )
 
 type MethodType int
@@ -19,6 +22,15 @@ const (
 	WaitForStopMethodType
 	StateMethodType
 	QuitMethodType
+	HealthMethodType
+	ImportMethodType
+	ExportMethodType
+	SetDisplayNameMethodType
+	EffectiveConfigMethodType
+	NewFromTemplateMethodType
+	DuplicateMethodType
+	RenameMethodType
+	DeleteMethodType
 )
 
 type TunnelState int
@@ -29,8 +41,27 @@ const (
 	TunnelStopped
 	TunnelStarting
 	TunnelStopping
+	TunnelDegraded
 )
 
+func (s TunnelState) String() string {
+	switch s {
+	case TunnelStarted:
+		return "Started"
+	case TunnelStopped:
+		return "Stopped"
+	case TunnelStarting:
+		return "Starting"
+	case TunnelStopping:
+		return "Stopping"
+	case TunnelDegraded:
+		return "Degraded"
+	}
+	return "Unknown"
+}
+
+const tunnelStopTimeout = 10 * time.Second
+
 var managerServices = make(map[*ManagerService]bool)
 var managerServicesLock sync.RWMutex
 var haveQuit uint32
@@ -51,29 +82,264 @@ func errToString(err error) string {
 }
 
 func (s *ManagerService) State(tunnelName string) (TunnelState, error) {
-	return TunnelStopped, nil
+	configPath, ok := adoptTunnel(tunnelName)
+	if !ok {
+		return TunnelStopped, nil
+	}
+	return QueryTunnelState(tunnelName, configPath)
+}
+
+func (s *ManagerService) Health(tunnelName string) ([]HealthCheckResult, error) {
+	configPath, ok := adoptTunnel(tunnelName)
+	if !ok {
+		return nil, fmt.Errorf("tunnel %s is not running", tunnelName)
+	}
+	status, err := ReadTunnelStatus(configPath)
+	if err != nil {
+		return nil, err
+	}
+	return status.Health, nil
+}
+
+// configRoots returns the config roots of the user on the other end of the connection, and among them the one new
+// tunnels of the user are written to. That is the Nebula config directory of the user, or the one recorded with
+// SaveConfigDirSetting if there is one.
+func (s *ManagerService) configRoots() ([]ConfigRoot, ConfigRoot, error) {
+	if s.elevatedToken == 0 {
+		return nil, ConfigRoot{}, windows.ERROR_ACCESS_DENIED
+	}
+	userRoot, err := s.userConfigRoot()
+	if err != nil {
+		return nil, ConfigRoot{}, err
+	}
+	return []ConfigRoot{{Path: MachineConfigDir(), Source: MachineTunnelSource}, userRoot}, userRoot, nil
+}
+
+func (s *ManagerService) userConfigRoot() (ConfigRoot, error) {
+	override, err := UserConfigDirSetting(s.elevatedToken)
+	if err != nil {
+		return ConfigRoot{}, err
+	}
+	if override != "" {
+		return ConfigRoot{Path: override, Source: OverrideTunnelSource}, nil
+	}
+	appData, err := s.elevatedToken.KnownFolderPath(windows.FOLDERID_RoamingAppData, windows.KF_FLAG_DEFAULT)
+	if err != nil {
+		return ConfigRoot{}, err
+	}
+	return ConfigRoot{Path: filepath.Join(appData, "Nebula"), Source: UserTunnelSource}, nil
+}
+
+func (s *ManagerService) Import(archivePath string, tunnelName string) (string, error) {
+	roots, userRoot, err := s.configRoots()
+	if err != nil {
+		return "", err
+	}
+	name, err := ImportTunnelBundle(roots, userRoot.Path, archivePath, tunnelName)
+	if err != nil {
+		return "", err
+	}
+	return name, nil
+}
+
+func (s *ManagerService) NewFromTemplate(templateName string, tunnelName string, values map[string]string) error {
+	roots, userRoot, err := s.configRoots()
+	if err != nil {
+		return err
+	}
+	t, err := FindTemplate(roots, templateName)
+	if err != nil {
+		return err
+	}
+	err = t.Render(userRoot.Path, tunnelName, values)
+	if err != nil {
+		return err
+	}
+	return nil
+}
+
+func (s *ManagerService) Export(tunnelName string, archivePath string, includeKey bool) error {
+	roots, _, err := s.configRoots()
+	if err != nil {
+		return err
+	}
+	tunnelPath, _, err := FindTunnelPath(roots, tunnelName)
+	if err != nil {
+		return err
+	}
+	return ExportTunnelBundle(tunnelPath, archivePath, includeKey)
+}
+
+func (s *ManagerService) EffectiveConfig(tunnelName string) (string, error) {
+	roots, _, err := s.configRoots()
+	if err != nil {
+		return "", err
+	}
+	tunnelPath, _, err := FindTunnelPath(roots, tunnelName)
+	if err != nil {
+		return "", err
+	}
+	return EffectiveConfig(tunnelPath)
+}
+
+func (s *ManagerService) SetDisplayName(tunnelName string, displayName string) error {
+	roots, _, err := s.configRoots()
+	if err != nil {
+		return err
+	}
+	tunnelPath, _, err := FindTunnelPath(roots, tunnelName)
+	if err != nil {
+		return err
+	}
+	err = SetTunnelDisplayName(tunnelPath, displayName)
+	if err != nil {
+		return err
+	}
+	return nil
 }
 
 func (s *ManagerService) Start(configPath string) (*Tunnel, error) {
 	tunnelName := filepath.Base(configPath)
-	err := InstallTunnelService(tunnelName, configPath)
-
+	t := Tunnel{
+		Path:        configPath,
+		Name:        tunnelName,
+		DisplayName: TunnelDisplayName(configPath),
+		State:       TunnelStarting,
+	}
+	err := CheckTunnelConflicts(t, trackedRunningTunnels())
 	if err != nil {
 		return nil, err
 	}
 
-	t := Tunnel{
-		Path:  configPath,
-		Name:  tunnelName,
-		State: TunnelStarted,
+	removeTunnelStatus(configPath)
+	err = InstallTunnelService(tunnelName, configPath)
+
+	if err != nil {
+		return nil, err
 	}
-	CurrentTunnels = append(CurrentTunnels, t)
+
+	Tunnels.Put(t)
+	trackTunnel(t)
 
 	return &t, nil
 }
 
 func (s *ManagerService) Stop(tunnelName string) error {
-	return UninstallTunnelService(tunnelName)
+	err := UninstallTunnelService(tunnelName)
+	if err != nil {
+		return err
+	}
+	Tunnels.SetState(tunnelName, TunnelStopped)
+	untrackTunnel(tunnelName)
+	return nil
+}
+
+// stopTunnelService stops and uninstalls the service of a tunnel if there is one and waits for it to go away, so
+// that its files are no longer in use.
+func stopTunnelService(tunnelName string, tunnelPath string) error {
+	state, err := QueryTunnelState(tunnelName, tunnelPath)
+	if err != nil && state == TunnelUnknown {
+		return err
+	}
+	UninstallTunnelService(tunnelName)
+	untrackTunnel(tunnelName)
+
+	for deadline := time.Now().Add(tunnelStopTimeout); ; {
+		state, _ = QueryTunnelState(tunnelName, tunnelPath)
+		if state == TunnelStopped {
+			return nil
+		}
+		if time.Now().After(deadline) {
+			return fmt.Errorf("tunnel %s did not stop", tunnelName)
+		}
+		time.Sleep(time.Second / 3)
+	}
+}
+
+func (s *ManagerService) Duplicate(tunnelName string, newName string) error {
+	if s.elevatedToken == 0 {
+		return windows.ERROR_ACCESS_DENIED
+	}
+	roots, userRoot, err := s.configRoots()
+	if err != nil {
+		return err
+	}
+	tunnelPath, _, err := FindTunnelPath(roots, tunnelName)
+	if err != nil {
+		return err
+	}
+	if _, _, err := FindTunnelPath(roots, newName); err == nil {
+		return fmt.Errorf("tunnel %s already exists", newName)
+	}
+	err = DuplicateTunnel(tunnelPath, userRoot.Path, newName)
+	if err != nil {
+		return err
+	}
+	return nil
+}
+
+func (s *ManagerService) Rename(tunnelName string, newName string) error {
+	if s.elevatedToken == 0 {
+		return windows.ERROR_ACCESS_DENIED
+	}
+	roots, _, err := s.configRoots()
+	if err != nil {
+		return err
+	}
+	tunnelPath, _, err := FindTunnelPath(roots, tunnelName)
+	if err != nil {
+		return err
+	}
+	if _, _, err := FindTunnelPath(roots, newName); err == nil {
+		return fmt.Errorf("tunnel %s already exists", newName)
+	}
+	state, err := QueryTunnelState(tunnelName, tunnelPath)
+	if err != nil && state == TunnelUnknown {
+		return err
+	}
+	if state != TunnelStopped {
+		return fmt.Errorf("tunnel %s must be stopped before it can be renamed", tunnelName)
+	}
+
+	// The service of a stopped tunnel still points at the old directory
+	err = UninstallTunnelService(tunnelName)
+	if err != nil && err != windows.ERROR_SERVICE_DOES_NOT_EXIST && err != windows.ERROR_SERVICE_MARKED_FOR_DELETE {
+		return fmt.Errorf("could not remove the service of %s: %s", tunnelName, err)
+	}
+	_, err = RenameTunnel(tunnelPath, newName)
+	if err != nil {
+		return err
+	}
+	Tunnels.Remove(tunnelName)
+	log.Printf("Renamed tunnel %s to %s", tunnelName, newName)
+	return nil
+}
+
+func (s *ManagerService) Delete(tunnelName string, archive bool) (string, error) {
+	if s.elevatedToken == 0 {
+		return "", windows.ERROR_ACCESS_DENIED
+	}
+	roots, _, err := s.configRoots()
+	if err != nil {
+		return "", err
+	}
+	tunnelPath, _, err := FindTunnelPath(roots, tunnelName)
+	if err != nil {
+		return "", err
+	}
+
+	err = stopTunnelService(tunnelName, tunnelPath)
+	if err != nil {
+		return "", err
+	}
+	Tunnels.Remove(tunnelName)
+
+	archivePath, err := DeleteTunnel(tunnelPath, archive)
+	if err != nil {
+		return "", err
+	}
+	log.Printf("Deleted tunnel %s", tunnelName)
+	return archivePath, nil
 }
 
 func (s *ManagerService) WaitForStop(tunnelName string) error {
@@ -98,7 +364,7 @@ func (s *ManagerService) Quit(stopTunnelsOnQuit bool) (alreadyQuit bool, err err
 
 	if stopTunnelsOnQuit {
 
-		for _, t := range CurrentTunnels {
+		for _, t := range Tunnels.Snapshot() {
 			UninstallTunnelService(t.Name)
 		}
 	}
@@ -125,6 +391,9 @@ func (s *ManagerService) ServeConn(reader io.Reader, writer io.Writer) {
 				return
 			}
 			tun, retErr := s.Start(configPath)
+			if tun == nil {
+				tun = &Tunnel{}
+			}
 			err = encoder.Encode(tun)
 			if err != nil {
 				return
@@ -170,6 +439,150 @@ func (s *ManagerService) ServeConn(reader io.Reader, writer io.Writer) {
 			if err != nil {
 				return
 			}
+		case HealthMethodType:
+			var tunnelName string
+			err := decoder.Decode(&tunnelName)
+			if err != nil {
+				return
+			}
+			health, retErr := s.Health(tunnelName)
+			err = encoder.Encode(health)
+			if err != nil {
+				return
+			}
+			err = encoder.Encode(errToString(retErr))
+			if err != nil {
+				return
+			}
+		case ImportMethodType:
+			var archivePath, tunnelName string
+			err := decoder.Decode(&archivePath)
+			if err != nil {
+				return
+			}
+			err = decoder.Decode(&tunnelName)
+			if err != nil {
+				return
+			}
+			name, retErr := s.Import(archivePath, tunnelName)
+			err = encoder.Encode(name)
+			if err != nil {
+				return
+			}
+			err = encoder.Encode(errToString(retErr))
+			if err != nil {
+				return
+			}
+		case ExportMethodType:
+			var tunnelName, archivePath string
+			var includeKey bool
+			err := decoder.Decode(&tunnelName)
+			if err != nil {
+				return
+			}
+			err = decoder.Decode(&archivePath)
+			if err != nil {
+				return
+			}
+			err = decoder.Decode(&includeKey)
+			if err != nil {
+				return
+			}
+			retErr := s.Export(tunnelName, archivePath, includeKey)
+			err = encoder.Encode(errToString(retErr))
+			if err != nil {
+				return
+			}
+		case SetDisplayNameMethodType:
+			var tunnelName, displayName string
+			err := decoder.Decode(&tunnelName)
+			if err != nil {
+				return
+			}
+			err = decoder.Decode(&displayName)
+			if err != nil {
+				return
+			}
+			retErr := s.SetDisplayName(tunnelName, displayName)
+			err = encoder.Encode(errToString(retErr))
+			if err != nil {
+				return
+			}
+		case EffectiveConfigMethodType:
+			var tunnelName string
+			err := decoder.Decode(&tunnelName)
+			if err != nil {
+				return
+			}
+			config, retErr := s.EffectiveConfig(tunnelName)
+			err = encoder.Encode(config)
+			if err != nil {
+				return
+			}
+			err = encoder.Encode(errToString(retErr))
+			if err != nil {
+				return
+			}
+		case NewFromTemplateMethodType:
+			var templateName, tunnelName string
+			var values map[string]string
+			err := decoder.Decode(&templateName)
+			if err != nil {
+				return
+			}
+			err = decoder.Decode(&tunnelName)
+			if err != nil {
+				return
+			}
+			err = decoder.Decode(&values)
+			if err != nil {
+				return
+			}
+			retErr := s.NewFromTemplate(templateName, tunnelName, values)
+			err = encoder.Encode(errToString(retErr))
+			if err != nil {
+				return
+			}
+		case DuplicateMethodType, RenameMethodType:
+			var tunnelName, newName string
+			err := decoder.Decode(&tunnelName)
+			if err != nil {
+				return
+			}
+			err = decoder.Decode(&newName)
+			if err != nil {
+				return
+			}
+			var retErr error
+			if methodType == DuplicateMethodType {
+				retErr = s.Duplicate(tunnelName, newName)
+			} else {
+				retErr = s.Rename(tunnelName, newName)
+			}
+			err = encoder.Encode(errToString(retErr))
+			if err != nil {
+				return
+			}
+		case DeleteMethodType:
+			var tunnelName string
+			var archive bool
+			err := decoder.Decode(&tunnelName)
+			if err != nil {
+				return
+			}
+			err = decoder.Decode(&archive)
+			if err != nil {
+				return
+			}
+			archivePath, retErr := s.Delete(tunnelName, archive)
+			err = encoder.Encode(archivePath)
+			if err != nil {
+				return
+			}
+			err = encoder.Encode(errToString(retErr))
+			if err != nil {
+				return
+			}
 		case QuitMethodType:
 			var stopTunnelsOnQuit bool
 			err := decoder.Decode(&stopTunnelsOnQuit)
@@ -201,7 +614,18 @@ func IPCServerListen(reader *os.File, writer *os.File, events *os.File, elevated
 		managerServicesLock.Lock()
 		managerServices[service] = true
 		managerServicesLock.Unlock()
+		// Tunnels of the user only concern this connection, the machine root is watched for everyone by the manager
+		var watcher *ConfigWatcher
+		if _, userRoot, err := service.configRoots(); err == nil {
+			watcher, err = WatchTunnelRoot(userRoot.Path, service.notifyTunnelsChange)
+			if err != nil {
+				log.Printf("Unable to watch %s: %v", userRoot.Path, err)
+			}
+		}
 		service.ServeConn(reader, writer)
+		if watcher != nil {
+			watcher.Stop()
+		}
 		managerServicesLock.Lock()
 		service.eventLock.Lock()
 		service.events = nil
@@ -210,3 +634,68 @@ func IPCServerListen(reader *os.File, writer *os.File, events *os.File, elevated
 		managerServicesLock.Unlock()
 	}()
 }
+
+func encodeNotification(notificationType NotificationType, ifaces ...interface{}) ([]byte, error) {
+	var buf bytes.Buffer
+	encoder := gob.NewEncoder(&buf)
+	err := encoder.Encode(notificationType)
+	if err != nil {
+		return nil, err
+	}
+	for _, iface := range ifaces {
+		err = encoder.Encode(iface)
+		if err != nil {
+			return nil, err
+		}
+	}
+	return buf.Bytes(), nil
+}
+
+func (s *ManagerService) sendNotification(notification []byte) {
+	s.eventLock.Lock()
+	if s.events != nil {
+		s.events.SetWriteDeadline(time.Now().Add(time.Second))
+		s.events.Write(notification)
+	}
+	s.eventLock.Unlock()
+}
+
+func notifyAll(notificationType NotificationType, ifaces ...interface{}) {
+	if len(managerServices) == 0 {
+		return
+	}
+
+	notification, err := encodeNotification(notificationType, ifaces...)
+	if err != nil {
+		return
+	}
+
+	managerServicesLock.RLock()
+	for m := range managerServices {
+		m.sendNotification(notification)
+	}
+	managerServicesLock.RUnlock()
+}
+
+func IPCServerNotifyTunnelChange(tunnelName string, state TunnelState, err error) {
+	notifyAll(TunnelChangeNotificationType, tunnelName, state, trackedGlobalState(), errToString(err))
+}
+
+// IPCServerNotifyTunnelsChange tells every UI to reload its tunnels. It is sent by the config watchers, see
+// WatchTunnelRoot, so that a change is reported once however it was made.
+func IPCServerNotifyTunnelsChange() {
+	notifyAll(TunnelsChangeNotificationType)
+}
+
+// notifyTunnelsChange tells the UI on this connection to reload its tunnels.
+func (s *ManagerService) notifyTunnelsChange() {
+	notification, err := encodeNotification(TunnelsChangeNotificationType)
+	if err != nil {
+		return
+	}
+	s.sendNotification(notification)
+}
+
+func IPCServerNotifyManagerStopping() {
+	notifyAll(ManagerStoppingNotificationType)
+}
@@ -0,0 +1,122 @@
+package manager
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+// archiveDirName holds deleted tunnels that were archived. Tunnel discovery skips it because it starts with a dot.
+const archiveDirName = ".archive"
+
+func checkNewTunnelName(root string, tunnelName string) (string, error) {
+	if tunnelName != SanitizeTunnelName(tunnelName) {
+		return "", fmt.Errorf("invalid tunnel name %q", tunnelName)
+	}
+	tunnelPath, err := TunnelPath(root, tunnelName)
+	if err != nil {
+		return "", err
+	}
+	if _, err := os.Stat(tunnelPath); err == nil {
+		return "", fmt.Errorf("tunnel %s already exists", tunnelName)
+	}
+	return tunnelPath, nil
+}
+
+// DuplicateTunnel copies the config of a tunnel into a new tunnel under root. Logs, status and controller generated
+// artifacts are not copied, and the copy is shown under its own name rather than the display name of the original.
+// Controller managed copies get their own key and certificate on first activation; other tunnels that hold a private
+// key can not be duplicated, as the copy would share their identity.
+func DuplicateTunnel(tunnelPath string, root string, newName string) error {
+	_, err := checkNewTunnelName(root, newName)
+	if err != nil {
+		return err
+	}
+
+	md, err := LoadTunnelMetadata(tunnelPath)
+	if err != nil {
+		return err
+	}
+	controllerManaged := md != nil && md.ControllerURL != ""
+
+	entries, err := ioutil.ReadDir(tunnelPath)
+	if err != nil {
+		return err
+	}
+	files := make(map[string][]byte)
+	for _, e := range entries {
+		if !e.Mode().IsRegular() {
+			continue
+		}
+		contents, err := ioutil.ReadFile(filepath.Join(tunnelPath, e.Name()))
+		if err != nil {
+			return err
+		}
+		if !isExportable(e.Name(), contents, true) {
+			continue
+		}
+		if !isExportable(e.Name(), contents, false) || isYAMLFile(e.Name()) && isPrivateKeyPEM(contents) {
+			if !controllerManaged {
+				return fmt.Errorf("%s holds the private key of the tunnel, a copy would share its identity", e.Name())
+			}
+			if !isYAMLFile(e.Name()) {
+				continue
+			}
+			contents, err = stripInlineKey(contents)
+			if err != nil {
+				return fmt.Errorf("%s is not valid YAML: %s", e.Name(), err)
+			}
+		}
+		files[e.Name()] = contents
+	}
+
+	if md != nil {
+		md.TunnelName = ""
+		md.Version = CurrentMetadataVersion
+		// The copy starts its own key lifecycle and pins the controller CA on its first activation
+		md.KeyState = nil
+		md.CAFingerprints = nil
+		files[metadataFileName], err = json.MarshalIndent(md, "", "  ")
+		if err != nil {
+			return err
+		}
+	}
+
+	return writeTunnelDir(root, newName, files)
+}
+
+// RenameTunnel moves a tunnel directory to a new name in the same root and returns its new path.
+func RenameTunnel(tunnelPath string, newName string) (string, error) {
+	newPath, err := checkNewTunnelName(filepath.Dir(tunnelPath), newName)
+	if err != nil {
+		return "", err
+	}
+	err = os.Rename(tunnelPath, newPath)
+	if err != nil {
+		return "", err
+	}
+	return newPath, nil
+}
+
+// DeleteTunnel removes a tunnel directory. If archive is set the directory is moved into the .archive directory of
+// its root instead, and the archive path is returned.
+func DeleteTunnel(tunnelPath string, archive bool) (string, error) {
+	if !archive {
+		return "", os.RemoveAll(tunnelPath)
+	}
+
+	archiveDir := filepath.Join(filepath.Dir(tunnelPath), archiveDirName)
+	err := os.MkdirAll(archiveDir, 0700)
+	if err != nil {
+		return "", err
+	}
+	archivePath := filepath.Join(archiveDir, fmt.Sprintf("%s-%s", filepath.Base(tunnelPath), time.Now().UTC().Format("20060102T150405Z")))
+	err = os.Rename(tunnelPath, archivePath)
+	if err != nil {
+		return "", err
+	}
+	return archivePath, nil
+}
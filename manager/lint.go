@@ -0,0 +1,179 @@
+package manager
+
+import (
+	"fmt"
+	"github.com/sirupsen/logrus"
+	"github.com/slackhq/nebula"
+	"github.com/slackhq/nebula/cert"
+	"io/ioutil"
+	"log"
+	"net"
+	"path/filepath"
+	"strings"
+)
+
+// TunnelConflict is a setting two tunnels can not share while both are running.
+type TunnelConflict struct {
+	Tunnel  string
+	Other   string
+	Problem string
+}
+
+func (c TunnelConflict) String() string {
+	return fmt.Sprintf("%s and %s: %s", c.Tunnel, c.Other, c.Problem)
+}
+
+// ConflictError is returned when a tunnel can not start because it collides with running tunnels.
+type ConflictError struct {
+	Conflicts []TunnelConflict
+}
+
+func (e *ConflictError) Error() string {
+	problems := make([]string, 0, len(e.Conflicts))
+	for _, c := range e.Conflicts {
+		problems = append(problems, c.String())
+	}
+	return fmt.Sprintf("tunnel conflicts with a running tunnel: %s", strings.Join(problems, "; "))
+}
+
+type namedNetwork struct {
+	what    string
+	network *net.IPNet
+}
+
+// tunnelNetwork holds the settings of a tunnel that must be unique on this machine. tun.dev is not one of them, nebula
+// ignores the device name on Windows.
+type tunnelNetwork struct {
+	name     string
+	port     int
+	networks []namedNetwork
+}
+
+func pkiCertPEM(tunnelPath string, value string) ([]byte, error) {
+	if strings.Contains(value, "-----BEGIN") {
+		return []byte(value), nil
+	}
+	if !filepath.IsAbs(value) {
+		value = filepath.Join(tunnelPath, value)
+	}
+	return ioutil.ReadFile(value)
+}
+
+func loadTunnelNetwork(t Tunnel) (*tunnelNetwork, error) {
+	l := logrus.New()
+	l.Out = ioutil.Discard
+
+	config := nebula.NewConfig(l)
+	err := config.Load(t.Path)
+	if err != nil {
+		return nil, err
+	}
+
+	n := &tunnelNetwork{
+		name: t.Name,
+		port: config.GetInt("listen.port", 0),
+	}
+
+	// nebula takes the tunnel network from the certificate and never reads tun.cidr
+	if certValue := config.GetString("pki.cert", ""); certValue != "" {
+		certPEM, err := pkiCertPEM(t.Path, certValue)
+		if err == nil {
+			nc, _, err := cert.UnmarshalNebulaCertificateFromPEM(certPEM)
+			if err == nil && len(nc.Details.Ips) > 0 {
+				ip := nc.Details.Ips[0]
+				n.networks = append(n.networks, namedNetwork{
+					what:    "tunnel network",
+					network: &net.IPNet{IP: ip.IP.Mask(ip.Mask), Mask: ip.Mask},
+				})
+			}
+		}
+	}
+
+	rawRoutes, _ := config.Get("tun.unsafe_routes").([]interface{})
+	for _, r := range rawRoutes {
+		m, ok := r.(map[interface{}]interface{})
+		if !ok {
+			continue
+		}
+		route := fmt.Sprint(m["route"])
+		_, network, err := net.ParseCIDR(route)
+		if err != nil {
+			return nil, fmt.Errorf("unsafe route %q is invalid: %s", route, err)
+		}
+		n.networks = append(n.networks, namedNetwork{what: "unsafe route", network: network})
+	}
+	return n, nil
+}
+
+func networksOverlap(a *net.IPNet, b *net.IPNet) bool {
+	return a.Contains(b.IP) || b.Contains(a.IP)
+}
+
+func tunnelConflicts(a *tunnelNetwork, b *tunnelNetwork) []TunnelConflict {
+	var conflicts []TunnelConflict
+	add := func(problem string, args ...interface{}) {
+		conflicts = append(conflicts, TunnelConflict{Tunnel: a.name, Other: b.name, Problem: fmt.Sprintf(problem, args...)})
+	}
+
+	if a.port != 0 && a.port == b.port {
+		add("both listen on port %d", a.port)
+	}
+	for _, na := range a.networks {
+		for _, nb := range b.networks {
+			if networksOverlap(na.network, nb.network) {
+				add("%s %s overlaps %s %s", na.what, na.network, nb.what, nb.network)
+			}
+		}
+	}
+	return conflicts
+}
+
+func loadTunnelNetworks(tunnels []Tunnel) []*tunnelNetwork {
+	networks := make([]*tunnelNetwork, 0, len(tunnels))
+	for _, t := range tunnels {
+		n, err := loadTunnelNetwork(t)
+		if err != nil {
+			log.Printf("Not checking %s for conflicts: %s", &t, err)
+			continue
+		}
+		networks = append(networks, n)
+	}
+	return networks
+}
+
+// LintTunnels reports every pair of tunnels that can not run side by side.
+func LintTunnels(tunnels []Tunnel) []TunnelConflict {
+	networks := loadTunnelNetworks(tunnels)
+
+	var conflicts []TunnelConflict
+	for i := range networks {
+		for j := i + 1; j < len(networks); j++ {
+			conflicts = append(conflicts, tunnelConflicts(networks[i], networks[j])...)
+		}
+	}
+	return conflicts
+}
+
+// CheckTunnelConflicts returns a ConflictError if t can not run alongside the running tunnels.
+func CheckTunnelConflicts(t Tunnel, running []Tunnel) error {
+	n, err := loadTunnelNetwork(t)
+	if err != nil {
+		return err
+	}
+
+	var others []Tunnel
+	for _, r := range running {
+		if r.Name != t.Name {
+			others = append(others, r)
+		}
+	}
+
+	var conflicts []TunnelConflict
+	for _, other := range loadTunnelNetworks(others) {
+		conflicts = append(conflicts, tunnelConflicts(n, other)...)
+	}
+	if len(conflicts) > 0 {
+		return &ConflictError{Conflicts: conflicts}
+	}
+	return nil
+}
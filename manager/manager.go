@@ -142,6 +142,12 @@ func (service *managerService) Execute(args []string, r <-chan svc.ChangeRequest
 
 	log.Println("Starting")
 
+	err = EnsureMachineConfigDir()
+	if err != nil {
+		log.Printf("Machine-wide tunnels will not be available: %v", err)
+		err = nil
+	}
+
 	path, err := os.Executable()
 	if err != nil {
 		serviceError = services.ErrorDetermineExecutablePath
@@ -291,10 +297,17 @@ func (service *managerService) Execute(args []string, r <-chan svc.ChangeRequest
 				Files: []*os.File{devNull, devNull, devNull},
 				Dir:   userProfileDirectory,
 			}
+			args := []string{path, "-ui", theirReaderStr, theirWriterStr, theirEventStr, theirLogMappingStr}
+			if configDir, err := UserConfigDirSetting(elevatedToken); err != nil {
+				log.Printf("Unable to read the config directory setting: %v", err)
+			} else if configDir != "" {
+				args = append([]string{path, "-config-dir", configDir}, args[1:]...)
+			}
+
 			procsLock.Lock()
 			var proc *os.Process
 			if alive := aliveSessions[session]; alive {
-				proc, err = os.StartProcess(path, []string{path, "-ui", theirReaderStr, theirWriterStr, theirEventStr, theirLogMappingStr}, attr)
+				proc, err = os.StartProcess(path, args, attr)
 			} else {
 				err = errors.New("Session has logged out")
 			}
@@ -395,6 +408,13 @@ func (service *managerService) Execute(args []string, r <-chan svc.ChangeRequest
 
 	changes <- svc.Status{State: svc.Running, Accepts: svc.AcceptStop | svc.AcceptSessionChange}
 
+	trackerStop := make(chan struct{})
+	go runTunnelTracker(trackerStop)
+	machineWatcher, err := WatchTunnelRoot(MachineConfigDir(), IPCServerNotifyTunnelsChange)
+	if err != nil {
+		log.Printf("Unable to watch %s: %v", MachineConfigDir(), err)
+	}
+
 	uninstall := false
 loop:
 	for {
@@ -442,10 +462,14 @@ loop:
 	}
 
 	changes <- svc.Status{State: svc.StopPending}
+	close(trackerStop)
+	if machineWatcher != nil {
+		machineWatcher.Stop()
+	}
 	procsLock.Lock()
 	stoppingManager = true
 
-	//IPCServerNotifyManagerStopping()
+	IPCServerNotifyManagerStopping()
 
 	for _, proc := range procs {
 		proc.Kill()
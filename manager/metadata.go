@@ -0,0 +1,395 @@
+package manager
+
+import (
+	"crypto/x509"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/url"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	metadataFileName       = "metadata.json"
+	CurrentMetadataVersion = 2
+)
+
+type SessionPolicy string
+
+const (
+	// SessionPolicyStopOnLogoff stops the tunnel when the user logs off and starts it again at logon.
+	SessionPolicyStopOnLogoff SessionPolicy = "stop_on_logoff"
+	// SessionPolicyAlways keeps the tunnel up regardless of user sessions.
+	SessionPolicyAlways SessionPolicy = "always"
+)
+
+var iconColorPattern = regexp.MustCompile(`^#[0-9a-fA-F]{6}$`)
+
+type HealthCheckConfig struct {
+	Targets          []string `json:"targets"`
+	IntervalSeconds  int      `json:"interval_seconds,omitempty"`
+	FailureThreshold int      `json:"failure_threshold,omitempty"`
+}
+
+// SignRequestConfig overrides the sign request defaults a controller advertises. An empty IP lets the controller
+// allocate one.
+type SignRequestConfig struct {
+	IP              string   `json:"ip,omitempty"`
+	DurationSeconds int      `json:"duration_seconds,omitempty"`
+	Groups          []string `json:"groups,omitempty"`
+	Subnets         []string `json:"subnets,omitempty"`
+}
+
+// KeyPolicyConfig controls when the keypair of a controller managed tunnel is replaced and its certificate renewed.
+type KeyPolicyConfig struct {
+	RotateAfterDays    int  `json:"rotate_after_days,omitempty"`
+	RenewBeforeSeconds int  `json:"renew_before_seconds,omitempty"`
+	RotateNow          bool `json:"rotate_now,omitempty"`
+}
+
+// HTTPConfig adjusts how the UI reaches the controller and identity provider of a tunnel. Proxy is empty for the
+// system proxy, "direct" for none or the URL of a proxy. RootCAs are PEM encoded CAs trusted on top of the system
+// roots.
+type HTTPConfig struct {
+	Proxy          string   `json:"proxy,omitempty"`
+	RootCAs        []string `json:"root_cas,omitempty"`
+	TimeoutSeconds int      `json:"timeout_seconds,omitempty"`
+}
+
+// KeyLifecycleState records what the last activation of a controller managed tunnel did with its key and
+// certificate.
+type KeyLifecycleState struct {
+	KeyCreated  time.Time `json:"key_created"`
+	KeyAction   string    `json:"key_action"`
+	CertAction  string    `json:"cert_action"`
+	Reason      string    `json:"reason,omitempty"`
+	CertExpires time.Time `json:"cert_expires,omitempty"`
+	Updated     time.Time `json:"updated"`
+}
+
+type ConfigMetadata struct {
+	Version        int                `json:"version"`
+	ControllerURL  string             `json:"controller_url,omitempty"`
+	TunnelName     string             `json:"tunnel_name,omitempty"`
+	Description    string             `json:"description,omitempty"`
+	Tags           []string           `json:"tags,omitempty"`
+	AutoConnect    bool               `json:"auto_connect,omitempty"`
+	SessionPolicy  SessionPolicy      `json:"session_policy,omitempty"`
+	IconColor      string             `json:"icon_color,omitempty"`
+	Fingerprint    string             `json:"fingerprint,omitempty"`
+	CAFingerprints []string           `json:"ca_fingerprints,omitempty"`
+	HealthChecks   *HealthCheckConfig `json:"health_checks,omitempty"`
+	SignRequest    *SignRequestConfig `json:"sign_request,omitempty"`
+	KeyPolicy      *KeyPolicyConfig   `json:"key_policy,omitempty"`
+	KeyState       *KeyLifecycleState `json:"key_state,omitempty"`
+	HTTP           *HTTPConfig        `json:"http,omitempty"`
+	DefaultConfig  string             `json:"default_config,omitempty"`
+	InsecureHTTP   bool               `json:"insecure_http,omitempty"`
+}
+
+// MetadataError lists every problem found in a tunnel's metadata.json.
+type MetadataError struct {
+	Path     string
+	Problems []string
+}
+
+func (e *MetadataError) Error() string {
+	return fmt.Sprintf("invalid %s: %s", e.Path, strings.Join(e.Problems, "; "))
+}
+
+// metadataMigrations upgrade the raw JSON of a metadata file one version at a time. Entry i migrates version i+1
+// to version i+2; files without a version field are version 1.
+var metadataMigrations = []func(raw map[string]interface{}) error{
+	// 1 -> 2: introduce the version field and make the implicit defaults of version 1 explicit
+	func(raw map[string]interface{}) error {
+		for _, key := range []string{"controller_url", "tunnel_name", "fingerprint"} {
+			if v, ok := raw[key].(string); ok && strings.TrimSpace(v) == "" {
+				delete(raw, key)
+			}
+		}
+		if v, ok := raw["controller_url"].(string); ok {
+			raw["controller_url"] = strings.TrimRight(strings.TrimSpace(v), "/")
+		}
+		raw["session_policy"] = string(SessionPolicyStopOnLogoff)
+		return nil
+	},
+}
+
+var metadataLock sync.Mutex
+
+func migrateMetadata(raw map[string]interface{}) (int, error) {
+	version := 1
+	if v, ok := raw["version"]; ok {
+		f, ok := v.(float64)
+		if !ok || f != float64(int(f)) || f < 1 {
+			return 0, errors.New("version must be a positive integer")
+		}
+		version = int(f)
+	}
+	if version > CurrentMetadataVersion {
+		return 0, fmt.Errorf("version %d is newer than the supported version %d", version, CurrentMetadataVersion)
+	}
+
+	from := version
+	for ; version < CurrentMetadataVersion; version++ {
+		err := metadataMigrations[version-1](raw)
+		if err != nil {
+			return 0, fmt.Errorf("migrating from version %d: %s", version, err)
+		}
+	}
+	raw["version"] = CurrentMetadataVersion
+	return from, nil
+}
+
+func (md *ConfigMetadata) Validate() []string {
+	var problems []string
+
+	if md.ControllerURL != "" {
+		u, err := url.Parse(md.ControllerURL)
+		if err != nil || !u.IsAbs() || u.Host == "" {
+			problems = append(problems, "controller_url must be an absolute URL")
+		} else if u.Scheme != "https" && u.Scheme != "http" {
+			problems = append(problems, "controller_url must be an http or https URL")
+		}
+	}
+	if strings.ContainsAny(md.TunnelName, "\r\n\t") {
+		problems = append(problems, "tunnel_name must be a single line")
+	}
+	if md.Fingerprint != "" {
+		if _, err := NormalizeFingerprint(md.Fingerprint); err != nil {
+			problems = append(problems, err.Error())
+		}
+	}
+	for _, fingerprint := range md.CAFingerprints {
+		if normalized, err := NormalizeFingerprint(fingerprint); err != nil || normalized != fingerprint {
+			problems = append(problems, "ca_fingerprints must be lowercase hex encoded SHA-256 hashes")
+			break
+		}
+	}
+	seenTags := make(map[string]bool)
+	for _, tag := range md.Tags {
+		if strings.TrimSpace(tag) == "" {
+			problems = append(problems, "tags must not be empty")
+		} else if seenTags[tag] {
+			problems = append(problems, fmt.Sprintf("tag %q is listed more than once", tag))
+		}
+		seenTags[tag] = true
+	}
+	switch md.SessionPolicy {
+	case "", SessionPolicyStopOnLogoff, SessionPolicyAlways:
+	default:
+		problems = append(problems, fmt.Sprintf("session_policy must be %q or %q", SessionPolicyStopOnLogoff, SessionPolicyAlways))
+	}
+	if md.IconColor != "" && !iconColorPattern.MatchString(md.IconColor) {
+		problems = append(problems, "icon_color must be a #rrggbb color")
+	}
+	if md.HealthChecks != nil {
+		for _, target := range md.HealthChecks.Targets {
+			host := target
+			if h, _, err := net.SplitHostPort(target); err == nil {
+				host = h
+			}
+			if net.ParseIP(host) == nil {
+				problems = append(problems, fmt.Sprintf("health check target %q is not an IP address", target))
+			}
+		}
+		if md.HealthChecks.IntervalSeconds < 0 {
+			problems = append(problems, "health_checks.interval_seconds must not be negative")
+		}
+		if md.HealthChecks.FailureThreshold < 0 {
+			problems = append(problems, "health_checks.failure_threshold must not be negative")
+		}
+	}
+	if md.SignRequest != nil {
+		if md.SignRequest.IP != "" {
+			if _, _, err := net.ParseCIDR(md.SignRequest.IP); err != nil {
+				problems = append(problems, "sign_request.ip must be an address in CIDR notation")
+			}
+		}
+		if md.SignRequest.DurationSeconds < 0 {
+			problems = append(problems, "sign_request.duration_seconds must not be negative")
+		}
+		for _, group := range md.SignRequest.Groups {
+			if strings.TrimSpace(group) == "" {
+				problems = append(problems, "sign_request.groups must not be empty")
+			}
+		}
+		for _, subnet := range md.SignRequest.Subnets {
+			if _, _, err := net.ParseCIDR(subnet); err != nil {
+				problems = append(problems, fmt.Sprintf("sign_request subnet %q is not in CIDR notation", subnet))
+			}
+		}
+	}
+	if md.DefaultConfig != "" {
+		if normalized, err := NormalizeFingerprint(md.DefaultConfig); err != nil || normalized != md.DefaultConfig {
+			problems = append(problems, "default_config must be a lowercase hex encoded SHA-256 hash")
+		}
+	}
+	if md.HTTP != nil {
+		if md.HTTP.Proxy != "" && md.HTTP.Proxy != "direct" {
+			u, err := url.Parse(md.HTTP.Proxy)
+			if err != nil || u.Host == "" || (u.Scheme != "http" && u.Scheme != "https" && u.Scheme != "socks5") {
+				problems = append(problems, `http.proxy must be "direct" or an http, https or socks5 URL`)
+			}
+		}
+		for i, ca := range md.HTTP.RootCAs {
+			if !x509.NewCertPool().AppendCertsFromPEM([]byte(ca)) {
+				problems = append(problems, fmt.Sprintf("http.root_cas entry %d is not a PEM encoded certificate", i+1))
+			}
+		}
+		if md.HTTP.TimeoutSeconds < 0 {
+			problems = append(problems, "http.timeout_seconds must not be negative")
+		}
+	}
+	if md.KeyPolicy != nil {
+		if md.KeyPolicy.RotateAfterDays < 0 {
+			problems = append(problems, "key_policy.rotate_after_days must not be negative")
+		}
+		if md.KeyPolicy.RenewBeforeSeconds < 0 {
+			problems = append(problems, "key_policy.renew_before_seconds must not be negative")
+		}
+	}
+	return problems
+}
+
+// Session returns the session policy, defaulting to stopping the tunnel on logoff.
+func (md *ConfigMetadata) Session() SessionPolicy {
+	if md == nil || md.SessionPolicy == "" {
+		return SessionPolicyStopOnLogoff
+	}
+	return md.SessionPolicy
+}
+
+func parseTunnelMetadata(metadataPath string, metadataRaw []byte) (*ConfigMetadata, bool, error) {
+	var raw map[string]interface{}
+	err := json.Unmarshal(metadataRaw, &raw)
+	if err != nil {
+		return nil, false, &MetadataError{Path: metadataPath, Problems: []string{err.Error()}}
+	}
+
+	from, err := migrateMetadata(raw)
+	if err != nil {
+		return nil, false, &MetadataError{Path: metadataPath, Problems: []string{err.Error()}}
+	}
+
+	migrated, err := json.Marshal(raw)
+	if err != nil {
+		return nil, false, err
+	}
+	var metaData ConfigMetadata
+	err = json.Unmarshal(migrated, &metaData)
+	if err != nil {
+		return nil, false, &MetadataError{Path: metadataPath, Problems: []string{err.Error()}}
+	}
+
+	if problems := metaData.Validate(); len(problems) > 0 {
+		return nil, false, &MetadataError{Path: metadataPath, Problems: problems}
+	}
+	return &metaData, from != CurrentMetadataVersion, nil
+}
+
+// LoadTunnelMetadata reads and validates the metadata.json of a tunnel, migrating older versions in memory. A tunnel
+// without metadata returns nil and no error.
+func LoadTunnelMetadata(configPath string) (*ConfigMetadata, error) {
+	metadataPath := filepath.Join(configPath, metadataFileName)
+	metadataRaw, err := ioutil.ReadFile(metadataPath)
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	md, _, err := parseTunnelMetadata(metadataPath, metadataRaw)
+	return md, err
+}
+
+func encodeTunnelMetadata(metadataPath string, md *ConfigMetadata) ([]byte, error) {
+	md.Version = CurrentMetadataVersion
+	if problems := md.Validate(); len(problems) > 0 {
+		return nil, &MetadataError{Path: metadataPath, Problems: problems}
+	}
+	return json.MarshalIndent(md, "", "  ")
+}
+
+// SaveTunnelMetadata validates md and atomically replaces the metadata.json of a tunnel with it.
+func SaveTunnelMetadata(configPath string, md *ConfigMetadata) error {
+	metadataPath := filepath.Join(configPath, metadataFileName)
+	metadataBytes, err := encodeTunnelMetadata(metadataPath, md)
+	if err != nil {
+		return err
+	}
+	return writeFileAtomic(metadataPath, metadataBytes, 0600)
+}
+
+// UpdateTunnelMetadata loads the metadata of a tunnel, or starts from empty metadata if there is none, applies update
+// and saves the result. Updates from within this process are serialized.
+func UpdateTunnelMetadata(configPath string, update func(md *ConfigMetadata) error) error {
+	metadataLock.Lock()
+	defer metadataLock.Unlock()
+
+	md, err := LoadTunnelMetadata(configPath)
+	if err != nil {
+		return err
+	}
+	if md == nil {
+		md = &ConfigMetadata{}
+	}
+
+	err = update(md)
+	if err != nil {
+		return err
+	}
+	return SaveTunnelMetadata(configPath, md)
+}
+
+// StageTunnelMetadata stages the metadata of the tunnel of tx with update applied, so that metadata describing the
+// artifacts is committed and rolled back together with them.
+func StageTunnelMetadata(tx *ArtifactTransaction, update func(md *ConfigMetadata) error) error {
+	md, err := LoadTunnelMetadata(tx.dir)
+	if err != nil {
+		return err
+	}
+	if md == nil {
+		md = &ConfigMetadata{}
+	}
+
+	err = update(md)
+	if err != nil {
+		return err
+	}
+	metadataBytes, err := encodeTunnelMetadata(filepath.Join(tx.dir, metadataFileName), md)
+	if err != nil {
+		return err
+	}
+	tx.Put(metadataFileName, metadataBytes)
+	return nil
+}
+
+// MigrateTunnelMetadata rewrites a tunnel's metadata.json in the current schema version if it is older.
+func MigrateTunnelMetadata(configPath string) (bool, error) {
+	metadataLock.Lock()
+	defer metadataLock.Unlock()
+
+	metadataPath := filepath.Join(configPath, metadataFileName)
+	metadataRaw, err := ioutil.ReadFile(metadataPath)
+	if os.IsNotExist(err) {
+		return false, nil
+	}
+	if err != nil {
+		return false, err
+	}
+
+	md, migrated, err := parseTunnelMetadata(metadataPath, metadataRaw)
+	if err != nil || !migrated {
+		return false, err
+	}
+	return true, SaveTunnelMetadata(configPath, md)
+}
@@ -0,0 +1,129 @@
+package manager
+
+import (
+	"encoding/binary"
+	"fmt"
+	"github.com/sirupsen/logrus"
+	"github.com/slackhq/nebula"
+	"net"
+	"time"
+)
+
+const (
+	readinessPollInterval = time.Second
+	readinessTimeout      = 30 * time.Second
+)
+
+// readinessMonitor watches the lighthouse handshakes and overlay health checks of a running nebula instance and
+// publishes the resulting tunnel state to the status file the manager reads.
+type readinessMonitor struct {
+	control     *nebula.Control
+	configPath  string
+	lighthouses []uint32
+	health      *healthChecker
+	l           *logrus.Logger
+	stop        chan struct{}
+	done        chan struct{}
+}
+
+func newReadinessMonitor(control *nebula.Control, config *nebula.Config, configPath string, l *logrus.Logger) *readinessMonitor {
+	rm := &readinessMonitor{
+		control:    control,
+		configPath: configPath,
+		l:          l,
+		stop:       make(chan struct{}),
+		done:       make(chan struct{}),
+	}
+
+	for _, lh := range config.GetStringSlice("lighthouse.hosts", []string{}) {
+		ip := net.ParseIP(lh).To4()
+		if ip == nil {
+			l.Printf("ignoring invalid lighthouse address %s for readiness checks\n", lh)
+			continue
+		}
+		rm.lighthouses = append(rm.lighthouses, binary.BigEndian.Uint32(ip))
+	}
+
+	md, err := LoadTunnelMetadata(configPath)
+	if err != nil {
+		l.Printf("health checks disabled: %s\n", err)
+	} else if md != nil {
+		rm.health = newHealthChecker(md.HealthChecks, l)
+	}
+
+	return rm
+}
+
+func (rm *readinessMonitor) reachableLighthouses() int {
+	reached := 0
+	for _, lh := range rm.lighthouses {
+		if rm.control.GetHostInfoByVpnIP(lh, false) != nil {
+			reached++
+		}
+	}
+	return reached
+}
+
+func (rm *readinessMonitor) run() {
+	started := time.Now()
+	ready := false
+	lastState := TunnelUnknown
+
+	ticker := time.NewTicker(readinessPollInterval)
+	defer func() {
+		ticker.Stop()
+		writeTunnelStatus(rm.configPath, &TunnelStatus{State: TunnelStopped})
+		close(rm.done)
+	}()
+
+	if rm.health != nil {
+		go rm.health.run(rm.stop)
+	}
+
+	for {
+		status := TunnelStatus{
+			LighthousesTotal: len(rm.lighthouses),
+		}
+		status.LighthousesReached = rm.reachableLighthouses()
+
+		switch {
+		case len(rm.lighthouses) == 0 || status.LighthousesReached > 0:
+			ready = true
+			status.State = TunnelStarted
+		case !ready && time.Since(started) < readinessTimeout:
+			status.State = TunnelStarting
+		default:
+			status.State = TunnelDegraded
+			status.Error = "no lighthouse is reachable"
+		}
+
+		if rm.health != nil {
+			status.Health = rm.health.Results()
+			if target, failing := rm.health.Failing(); failing && status.State == TunnelStarted {
+				status.State = TunnelDegraded
+				status.Error = fmt.Sprintf("health check %s is failing", target)
+			}
+		}
+
+		if status.State != lastState {
+			rm.l.Printf("tunnel state is now %s (%d/%d lighthouses reachable)\n", status.State, status.LighthousesReached, status.LighthousesTotal)
+			lastState = status.State
+		}
+
+		err := writeTunnelStatus(rm.configPath, &status)
+		if err != nil {
+			rm.l.Printf("failed to write tunnel status: %s\n", err)
+		}
+
+		select {
+		case <-rm.stop:
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+func (rm *readinessMonitor) Stop() {
+	close(rm.stop)
+	<-rm.done
+}
@@ -0,0 +1,164 @@
+package manager
+
+import (
+	"fmt"
+	"sort"
+	"sync"
+)
+
+// TunnelRegistry holds the tunnels known to a process, keyed by tunnel name. All methods are safe for concurrent
+// use and hand out copies, so callers never share a Tunnel with the registry.
+type TunnelRegistry struct {
+	lock      sync.RWMutex
+	tunnels   map[string]Tunnel
+	callbacks map[*TunnelRegistryCallback]bool
+}
+
+type TunnelRegistryCallback struct {
+	cb       func()
+	registry *TunnelRegistry
+}
+
+// Tunnels is the registry of this process. The manager records the tunnels it started, the UI every configured
+// tunnel.
+var Tunnels = NewTunnelRegistry()
+
+func NewTunnelRegistry() *TunnelRegistry {
+	return &TunnelRegistry{
+		tunnels:   make(map[string]Tunnel),
+		callbacks: make(map[*TunnelRegistryCallback]bool),
+	}
+}
+
+// Get returns the tunnel with the given name.
+func (r *TunnelRegistry) Get(tunnelName string) (Tunnel, bool) {
+	r.lock.RLock()
+	defer r.lock.RUnlock()
+
+	t, ok := r.tunnels[tunnelName]
+	return t, ok
+}
+
+// Snapshot returns all tunnels sorted by name.
+func (r *TunnelRegistry) Snapshot() []Tunnel {
+	r.lock.RLock()
+	tunnels := make([]Tunnel, 0, len(r.tunnels))
+	for _, t := range r.tunnels {
+		tunnels = append(tunnels, t)
+	}
+	r.lock.RUnlock()
+
+	sort.Slice(tunnels, func(i, j int) bool { return tunnels[i].Name < tunnels[j].Name })
+	return tunnels
+}
+
+func (r *TunnelRegistry) Len() int {
+	r.lock.RLock()
+	defer r.lock.RUnlock()
+	return len(r.tunnels)
+}
+
+// Add registers a new tunnel, failing if one with the same name is already known.
+func (r *TunnelRegistry) Add(t Tunnel) error {
+	r.lock.Lock()
+	if _, ok := r.tunnels[t.Name]; ok {
+		r.lock.Unlock()
+		return fmt.Errorf("tunnel %s already exists", t.Name)
+	}
+	r.tunnels[t.Name] = t
+	r.lock.Unlock()
+
+	r.notify()
+	return nil
+}
+
+// Put registers t, replacing any tunnel with the same name.
+func (r *TunnelRegistry) Put(t Tunnel) {
+	r.lock.Lock()
+	r.tunnels[t.Name] = t
+	r.lock.Unlock()
+
+	r.notify()
+}
+
+// Update applies update to the tunnel with the given name. update runs with the registry locked and must not call
+// back into it. The name of a tunnel can not be changed this way.
+func (r *TunnelRegistry) Update(tunnelName string, update func(t *Tunnel)) bool {
+	r.lock.Lock()
+	t, ok := r.tunnels[tunnelName]
+	if ok {
+		update(&t)
+		t.Name = tunnelName
+		r.tunnels[tunnelName] = t
+	}
+	r.lock.Unlock()
+
+	if ok {
+		r.notify()
+	}
+	return ok
+}
+
+// SetState records the state of a tunnel, returning false if it is unknown.
+func (r *TunnelRegistry) SetState(tunnelName string, state TunnelState) bool {
+	return r.Update(tunnelName, func(t *Tunnel) {
+		t.State = state
+	})
+}
+
+func (r *TunnelRegistry) Remove(tunnelName string) bool {
+	r.lock.Lock()
+	_, ok := r.tunnels[tunnelName]
+	delete(r.tunnels, tunnelName)
+	r.lock.Unlock()
+
+	if ok {
+		r.notify()
+	}
+	return ok
+}
+
+// Replace swaps in a freshly loaded list of tunnels. Tunnels that were already known keep their state.
+func (r *TunnelRegistry) Replace(tunnels []Tunnel) {
+	r.lock.Lock()
+	replaced := make(map[string]Tunnel, len(tunnels))
+	for _, t := range tunnels {
+		if existing, ok := r.tunnels[t.Name]; ok {
+			t.State = existing.State
+		}
+		replaced[t.Name] = t
+	}
+	r.tunnels = replaced
+	r.lock.Unlock()
+
+	r.notify()
+}
+
+// Subscribe registers cb to be called after every change. Callbacks run on the goroutine that made the change,
+// without the registry locked.
+func (r *TunnelRegistry) Subscribe(cb func()) *TunnelRegistryCallback {
+	s := &TunnelRegistryCallback{cb: cb, registry: r}
+	r.lock.Lock()
+	r.callbacks[s] = true
+	r.lock.Unlock()
+	return s
+}
+
+func (cb *TunnelRegistryCallback) Unregister() {
+	cb.registry.lock.Lock()
+	delete(cb.registry.callbacks, cb)
+	cb.registry.lock.Unlock()
+}
+
+func (r *TunnelRegistry) notify() {
+	r.lock.RLock()
+	callbacks := make([]*TunnelRegistryCallback, 0, len(r.callbacks))
+	for cb := range r.callbacks {
+		callbacks = append(callbacks, cb)
+	}
+	r.lock.RUnlock()
+
+	for _, cb := range callbacks {
+		cb.cb()
+	}
+}
@@ -0,0 +1,156 @@
+package manager
+
+import (
+	"fmt"
+	"sync"
+	"sync/atomic"
+	"testing"
+)
+
+func TestTunnelRegistrySnapshotIsolation(t *testing.T) {
+	r := NewTunnelRegistry()
+	if err := r.Add(Tunnel{Name: "b", State: TunnelStopped}); err != nil {
+		t.Fatal(err)
+	}
+	if err := r.Add(Tunnel{Name: "a", State: TunnelStopped}); err != nil {
+		t.Fatal(err)
+	}
+	if err := r.Add(Tunnel{Name: "a"}); err == nil {
+		t.Fatal("adding a duplicate tunnel succeeded")
+	}
+
+	snapshot := r.Snapshot()
+	if len(snapshot) != 2 || snapshot[0].Name != "a" || snapshot[1].Name != "b" {
+		t.Fatalf("unexpected snapshot %v", snapshot)
+	}
+	snapshot[0].State = TunnelStarted
+	snapshot[0].DisplayName = "changed"
+	if tunnel, _ := r.Get("a"); tunnel.State != TunnelStopped || tunnel.DisplayName != "" {
+		t.Fatalf("changing a snapshot changed the registry: %v", tunnel)
+	}
+
+	tunnel, _ := r.Get("b")
+	tunnel.State = TunnelStarted
+	if tunnel, _ := r.Get("b"); tunnel.State != TunnelStopped {
+		t.Fatalf("changing a returned tunnel changed the registry: %v", tunnel)
+	}
+
+	r.Update("a", func(t *Tunnel) {
+		t.Name = "renamed"
+		t.State = TunnelStarting
+	})
+	if tunnel, ok := r.Get("a"); !ok || tunnel.State != TunnelStarting {
+		t.Fatalf("update did not apply: %v", tunnel)
+	}
+	if _, ok := r.Get("renamed"); ok {
+		t.Fatal("update renamed a tunnel")
+	}
+	if snapshot[0].State != TunnelStarted || len(snapshot) != 2 {
+		t.Fatalf("changing the registry changed a snapshot: %v", snapshot)
+	}
+
+	r.Replace([]Tunnel{{Name: "a", State: TunnelStopped}, {Name: "c"}})
+	if tunnel, _ := r.Get("a"); tunnel.State != TunnelStarting {
+		t.Fatalf("replace lost the state of a known tunnel: %v", tunnel)
+	}
+	if _, ok := r.Get("b"); ok {
+		t.Fatal("replace kept a removed tunnel")
+	}
+}
+
+func TestTunnelRegistryCallbacks(t *testing.T) {
+	r := NewTunnelRegistry()
+	var calls int32
+	cb := r.Subscribe(func() {
+		// Callbacks run without the registry locked, so reading it must not deadlock.
+		r.Snapshot()
+		atomic.AddInt32(&calls, 1)
+	})
+
+	r.Add(Tunnel{Name: "a"})
+	r.Put(Tunnel{Name: "b"})
+	r.SetState("a", TunnelStarted)
+	r.Remove("b")
+	r.Replace([]Tunnel{{Name: "a"}})
+	if n := atomic.LoadInt32(&calls); n != 5 {
+		t.Fatalf("expected 5 callbacks, got %d", n)
+	}
+
+	// Operations that change nothing do not notify.
+	r.Add(Tunnel{Name: "a"})
+	r.SetState("missing", TunnelStarted)
+	r.Remove("missing")
+	if n := atomic.LoadInt32(&calls); n != 5 {
+		t.Fatalf("no-op changes notified, got %d callbacks", n)
+	}
+
+	cb.Unregister()
+	r.Put(Tunnel{Name: "c"})
+	if n := atomic.LoadInt32(&calls); n != 5 {
+		t.Fatalf("unregistered callback was called, got %d callbacks", n)
+	}
+}
+
+// Run with -race.
+func TestTunnelRegistryConcurrent(t *testing.T) {
+	const workers = 8
+	const rounds = 200
+
+	r := NewTunnelRegistry()
+	var calls int32
+	r.Subscribe(func() { atomic.AddInt32(&calls, 1) })
+
+	var wg sync.WaitGroup
+	for w := 0; w < workers; w++ {
+		wg.Add(1)
+		go func(w int) {
+			defer wg.Done()
+			name := fmt.Sprintf("tunnel%d", w)
+			for i := 0; i < rounds; i++ {
+				if err := r.Add(Tunnel{Name: name, State: TunnelStopped}); err != nil {
+					t.Error(err)
+					return
+				}
+				if !r.SetState(name, TunnelStarted) {
+					t.Errorf("%s vanished before SetState", name)
+					return
+				}
+				if tunnel, ok := r.Get(name); !ok || tunnel.State != TunnelStarted {
+					t.Errorf("%s has unexpected state %v", name, tunnel)
+					return
+				}
+				for _, tunnel := range r.Snapshot() {
+					tunnel.State = TunnelDegraded
+				}
+				if !r.Remove(name) {
+					t.Errorf("%s vanished before Remove", name)
+					return
+				}
+			}
+		}(w)
+	}
+
+	for s := 0; s < 2; s++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := 0; i < rounds; i++ {
+				r.Subscribe(func() {}).Unregister()
+				for _, tunnel := range r.Snapshot() {
+					if tunnel.State == TunnelDegraded {
+						t.Error("a snapshot change leaked into the registry")
+						return
+					}
+				}
+			}
+		}()
+	}
+	wg.Wait()
+
+	if r.Len() != 0 {
+		t.Fatalf("expected an empty registry, got %v", r.Snapshot())
+	}
+	if n := atomic.LoadInt32(&calls); n != workers*rounds*3 {
+		t.Fatalf("expected %d callbacks, got %d", workers*rounds*3, n)
+	}
+}
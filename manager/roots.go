@@ -0,0 +1,215 @@
+package manager
+
+import (
+	"fmt"
+	"golang.org/x/sys/windows"
+	"golang.org/x/sys/windows/registry"
+	"os"
+	"path/filepath"
+	"strings"
+	"unsafe"
+)
+
+const (
+	configDirEnv = "NEBULA_CONFIG_DIR"
+	// The manager service and the UI it starts see neither the command line nor the environment of the user who
+	// installed it, so the override is recorded here when installing.
+	configDirSettingKey   = `Software\Nebula`
+	configDirSettingValue = "ConfigDir"
+)
+
+// Admins and SYSTEM get full control over the machine root, everyone else can only read it.
+const machineConfigRootSDDL = "O:BAD:PAI(A;OICI;FA;;;SY)(A;OICI;FA;;;BA)(A;OICI;FR;;;BU)"
+
+type TunnelSource int
+
+const (
+	UserTunnelSource TunnelSource = iota
+	MachineTunnelSource
+	OverrideTunnelSource
+)
+
+func (s TunnelSource) String() string {
+	switch s {
+	case MachineTunnelSource:
+		return "machine"
+	case OverrideTunnelSource:
+		return "override"
+	}
+	return "user"
+}
+
+type ConfigRoot struct {
+	Path   string
+	Source TunnelSource
+}
+
+var configDirOverride string
+
+// IsAdmin is set when the current user may modify machine-wide tunnels.
+var IsAdmin bool
+
+// SetConfigDirOverride replaces the per-user config root, taking precedence over NEBULA_CONFIG_DIR.
+func SetConfigDirOverride(dir string) {
+	configDirOverride = dir
+}
+
+func MachineConfigDir() string {
+	programData, err := windows.KnownFolderPath(windows.FOLDERID_ProgramData, windows.KF_FLAG_DEFAULT)
+	if err != nil {
+		programData = os.Getenv("ProgramData")
+	}
+	return filepath.Join(programData, "Nebula")
+}
+
+// ConfigDirOverride returns the per-user config root given with -config-dir or NEBULA_CONFIG_DIR, or an empty string.
+func ConfigDirOverride() string {
+	if configDirOverride != "" {
+		return configDirOverride
+	}
+	return os.Getenv(configDirEnv)
+}
+
+// SaveConfigDirSetting records dir as the per-user config root of the manager service and every UI it starts. dir may
+// reference environment variables such as %USERPROFILE%, which are expanded for each user. An empty dir removes the
+// setting.
+func SaveConfigDirSetting(dir string) error {
+	key, _, err := registry.CreateKey(registry.LOCAL_MACHINE, configDirSettingKey, registry.SET_VALUE)
+	if err != nil {
+		return err
+	}
+	defer key.Close()
+
+	if dir == "" {
+		err = key.DeleteValue(configDirSettingValue)
+		if err == registry.ErrNotExist {
+			return nil
+		}
+		return err
+	}
+	if !strings.Contains(dir, "%") {
+		dir, err = filepath.Abs(dir)
+		if err != nil {
+			return err
+		}
+	}
+	return key.SetExpandStringValue(configDirSettingValue, dir)
+}
+
+// UserConfigDirSetting returns the config root recorded by SaveConfigDirSetting, expanded for the user of token, or
+// an empty string if there is none.
+func UserConfigDirSetting(token windows.Token) (string, error) {
+	key, err := registry.OpenKey(registry.LOCAL_MACHINE, configDirSettingKey, registry.QUERY_VALUE)
+	if err == registry.ErrNotExist {
+		return "", nil
+	}
+	if err != nil {
+		return "", err
+	}
+	defer key.Close()
+
+	dir, _, err := key.GetStringValue(configDirSettingValue)
+	if err == registry.ErrNotExist {
+		return "", nil
+	}
+	if err != nil {
+		return "", err
+	}
+	env, err := token.Environ(false)
+	if err != nil {
+		return "", err
+	}
+	return expandEnvironment(dir, env), nil
+}
+
+// expandEnvironment replaces %NAME% references in s with the values in env. Unknown names are left alone.
+func expandEnvironment(s string, env []string) string {
+	vars := make(map[string]string, len(env))
+	for _, kv := range env {
+		if i := strings.Index(kv, "="); i > 0 {
+			vars[strings.ToUpper(kv[:i])] = kv[i+1:]
+		}
+	}
+
+	var b strings.Builder
+	for {
+		start := strings.Index(s, "%")
+		if start < 0 {
+			break
+		}
+		end := strings.Index(s[start+1:], "%")
+		if end < 0 {
+			break
+		}
+		end += start + 1
+		if v, ok := vars[strings.ToUpper(s[start+1:end])]; ok {
+			b.WriteString(s[:start])
+			b.WriteString(v)
+			s = s[end+1:]
+		} else {
+			b.WriteString(s[:end])
+			s = s[end:]
+		}
+	}
+	b.WriteString(s)
+	return b.String()
+}
+
+// UserConfigRoot returns the root new tunnels are created in: the override if one is set, otherwise the per-user
+// root.
+func UserConfigRoot() ConfigRoot {
+	if override := ConfigDirOverride(); override != "" {
+		return ConfigRoot{Path: override, Source: OverrideTunnelSource}
+	}
+	return ConfigRoot{Path: NebulaConfigDir(), Source: UserTunnelSource}
+}
+
+// ConfigRoots returns the tunnel config roots in precedence order. The machine root always comes first so
+// admin-provisioned tunnels cannot be shadowed by a user's own.
+func ConfigRoots() []ConfigRoot {
+	return []ConfigRoot{
+		{Path: MachineConfigDir(), Source: MachineTunnelSource},
+		UserConfigRoot(),
+	}
+}
+
+// FindTunnelPath looks up a tunnel by name in the given roots.
+func FindTunnelPath(roots []ConfigRoot, tunnelName string) (string, ConfigRoot, error) {
+	for _, r := range roots {
+		tunnelPath, err := TunnelPath(r.Path, tunnelName)
+		if err != nil {
+			return "", ConfigRoot{}, err
+		}
+		if fi, err := os.Stat(tunnelPath); err == nil && fi.IsDir() {
+			return tunnelPath, r, nil
+		}
+	}
+	return "", ConfigRoot{}, fmt.Errorf("tunnel %s does not exist", tunnelName)
+}
+
+// EnsureMachineConfigDir creates the machine-wide config root with an ACL that makes it read-only to non-admins.
+func EnsureMachineConfigDir() error {
+	machineDir := MachineConfigDir()
+	if _, err := os.Stat(machineDir); err == nil {
+		return nil
+	}
+
+	sd, err := windows.SecurityDescriptorFromString(machineConfigRootSDDL)
+	if err != nil {
+		return err
+	}
+	sa := &windows.SecurityAttributes{
+		SecurityDescriptor: sd,
+	}
+	sa.Length = uint32(unsafe.Sizeof(*sa))
+
+	dirPtr, err := windows.UTF16PtrFromString(machineDir)
+	if err != nil {
+		return err
+	}
+	err = windows.CreateDirectory(dirPtr, sa)
+	if err != nil && err != windows.ERROR_ALREADY_EXISTS {
+		return fmt.Errorf("could not create %s: %v", machineDir, err)
+	}
+	return nil
+}
@@ -0,0 +1,54 @@
+package manager
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+const statusFileName = "tunnel.status.json"
+
+type TunnelStatus struct {
+	State              TunnelState         `json:"state"`
+	LighthousesTotal   int                 `json:"lighthouses_total"`
+	LighthousesReached int                 `json:"lighthouses_reached"`
+	Health             []HealthCheckResult `json:"health,omitempty"`
+	Updated            time.Time           `json:"updated"`
+	Error              string              `json:"error,omitempty"`
+}
+
+func writeTunnelStatus(configPath string, status *TunnelStatus) error {
+	status.Updated = time.Now()
+	statusBytes, err := json.Marshal(status)
+	if err != nil {
+		return err
+	}
+
+	statusPath := filepath.Join(configPath, statusFileName)
+	tmpPath := statusPath + ".tmp"
+	err = ioutil.WriteFile(tmpPath, statusBytes, 0644)
+	if err != nil {
+		return err
+	}
+	return os.Rename(tmpPath, statusPath)
+}
+
+func ReadTunnelStatus(configPath string) (*TunnelStatus, error) {
+	statusBytes, err := ioutil.ReadFile(filepath.Join(configPath, statusFileName))
+	if err != nil {
+		return nil, err
+	}
+
+	var status TunnelStatus
+	err = json.Unmarshal(statusBytes, &status)
+	if err != nil {
+		return nil, err
+	}
+	return &status, nil
+}
+
+func removeTunnelStatus(configPath string) {
+	os.Remove(filepath.Join(configPath, statusFileName))
+}
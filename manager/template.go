@@ -0,0 +1,477 @@
+package manager
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"gopkg.in/yaml.v3"
+	"io/ioutil"
+	"log"
+	"net"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+const (
+	// templatesDirName is skipped by tunnel discovery because it starts with a dot.
+	templatesDirName         = ".templates"
+	templateManifestName     = "template.json"
+	templateTunnelNameVar    = "tunnel_name"
+	maxTemplateFileSize      = 1 << 20
+	maxTemplateVariableCount = 64
+)
+
+// Placeholders look like ${name}. On their own they stand for a whole YAML (or JSON) value, inside a string for the
+// text of the value.
+var templatePlaceholder = regexp.MustCompile(`\$\{([A-Za-z_][A-Za-z0-9_]*)\}`)
+
+var templateVariableName = regexp.MustCompile(`^[A-Za-z_][A-Za-z0-9_]*$`)
+
+type TemplateVariableType string
+
+const (
+	TemplateString     TemplateVariableType = "string"
+	TemplateInt        TemplateVariableType = "int"
+	TemplatePort       TemplateVariableType = "port"
+	TemplateBool       TemplateVariableType = "bool"
+	TemplateIP         TemplateVariableType = "ip"
+	TemplateIPList     TemplateVariableType = "ip_list"
+	TemplateCIDR       TemplateVariableType = "cidr"
+	TemplateStringList TemplateVariableType = "string_list"
+)
+
+type TemplateVariable struct {
+	Name        string               `json:"name"`
+	Description string               `json:"description,omitempty"`
+	Type        TemplateVariableType `json:"type,omitempty"`
+	Required    bool                 `json:"required,omitempty"`
+	Default     string               `json:"default,omitempty"`
+	Pattern     string               `json:"pattern,omitempty"`
+}
+
+type TemplateManifest struct {
+	Description string             `json:"description,omitempty"`
+	Variables   []TemplateVariable `json:"variables"`
+}
+
+type TunnelTemplate struct {
+	Name     string
+	Path     string
+	Source   TunnelSource
+	Manifest TemplateManifest
+}
+
+// TemplateError lists every variable value that did not validate.
+type TemplateError struct {
+	Template string
+	Problems []string
+}
+
+func (e *TemplateError) Error() string {
+	return fmt.Sprintf("invalid values for template %s: %s", e.Template, strings.Join(e.Problems, "; "))
+}
+
+func (m *TemplateManifest) validate() error {
+	if len(m.Variables) > maxTemplateVariableCount {
+		return fmt.Errorf("too many variables, at most %d are allowed", maxTemplateVariableCount)
+	}
+	seen := make(map[string]bool)
+	for _, v := range m.Variables {
+		if !templateVariableName.MatchString(v.Name) {
+			return fmt.Errorf("invalid variable name %q", v.Name)
+		}
+		if v.Name == templateTunnelNameVar {
+			return fmt.Errorf("variable %s is set from the tunnel name and can not be declared", templateTunnelNameVar)
+		}
+		if seen[v.Name] {
+			return fmt.Errorf("variable %s is declared more than once", v.Name)
+		}
+		seen[v.Name] = true
+
+		switch v.Type {
+		case "", TemplateString, TemplateInt, TemplatePort, TemplateBool, TemplateIP, TemplateIPList, TemplateCIDR, TemplateStringList:
+		default:
+			return fmt.Errorf("variable %s has unknown type %q", v.Name, v.Type)
+		}
+		if v.Pattern != "" {
+			if _, err := regexp.Compile(v.Pattern); err != nil {
+				return fmt.Errorf("variable %s has an invalid pattern: %s", v.Name, err)
+			}
+		}
+	}
+	return nil
+}
+
+// LoadTemplate reads the manifest of the template in dir.
+func LoadTemplate(dir string) (*TunnelTemplate, error) {
+	manifestPath := filepath.Join(dir, templateManifestName)
+	manifestBytes, err := ioutil.ReadFile(manifestPath)
+	if err != nil {
+		return nil, err
+	}
+
+	t := &TunnelTemplate{Name: filepath.Base(dir), Path: dir}
+	err = json.Unmarshal(manifestBytes, &t.Manifest)
+	if err != nil {
+		return nil, fmt.Errorf("invalid %s: %s", manifestPath, err)
+	}
+	err = t.Manifest.validate()
+	if err != nil {
+		return nil, fmt.Errorf("invalid %s: %s", manifestPath, err)
+	}
+	return t, nil
+}
+
+// ListTemplates returns the templates in the .templates directory of every root. Like tunnels, a template in an
+// earlier root hides one with the same name in a later root.
+func ListTemplates(roots []ConfigRoot) []*TunnelTemplate {
+	var templates []*TunnelTemplate
+	seen := make(map[string]bool)
+	for _, r := range roots {
+		entries, err := ioutil.ReadDir(filepath.Join(r.Path, templatesDirName))
+		if err != nil {
+			continue
+		}
+		for _, e := range entries {
+			if !e.IsDir() || seen[e.Name()] {
+				continue
+			}
+			t, err := LoadTemplate(filepath.Join(r.Path, templatesDirName, e.Name()))
+			if err != nil {
+				log.Printf("Ignoring template %s: %s", e.Name(), err)
+				continue
+			}
+			t.Source = r.Source
+			seen[t.Name] = true
+			templates = append(templates, t)
+		}
+	}
+	sort.Slice(templates, func(i, j int) bool { return templates[i].Name < templates[j].Name })
+	return templates
+}
+
+// FindTemplate looks up a template by name in the given roots.
+func FindTemplate(roots []ConfigRoot, templateName string) (*TunnelTemplate, error) {
+	if templateName == "" || templateName != filepath.Base(templateName) || strings.HasPrefix(templateName, ".") {
+		return nil, fmt.Errorf("invalid template name %q", templateName)
+	}
+	for _, r := range roots {
+		dir := filepath.Join(r.Path, templatesDirName, templateName)
+		if fi, err := os.Stat(dir); err != nil || !fi.IsDir() {
+			continue
+		}
+		t, err := LoadTemplate(dir)
+		if err != nil {
+			return nil, err
+		}
+		t.Source = r.Source
+		return t, nil
+	}
+	return nil, fmt.Errorf("template %s does not exist", templateName)
+}
+
+func splitList(value string) []string {
+	var items []string
+	for _, item := range strings.Split(value, ",") {
+		if item = strings.TrimSpace(item); item != "" {
+			items = append(items, item)
+		}
+	}
+	return items
+}
+
+// parseValue converts the raw value of a variable to the Go value that is rendered into the template.
+func (v *TemplateVariable) parseValue(raw string) (interface{}, error) {
+	if v.Pattern != "" && !regexp.MustCompile(v.Pattern).MatchString(raw) {
+		return nil, fmt.Errorf("does not match %s", v.Pattern)
+	}
+
+	switch v.Type {
+	case TemplateInt:
+		return strconv.Atoi(raw)
+	case TemplatePort:
+		port, err := strconv.Atoi(raw)
+		if err != nil || port < 0 || port > 65535 {
+			return nil, errors.New("must be a port number between 0 and 65535")
+		}
+		return port, nil
+	case TemplateBool:
+		return strconv.ParseBool(raw)
+	case TemplateIP:
+		if net.ParseIP(raw) == nil {
+			return nil, errors.New("must be an IP address")
+		}
+		return raw, nil
+	case TemplateIPList:
+		items := splitList(raw)
+		for _, item := range items {
+			if net.ParseIP(item) == nil {
+				return nil, fmt.Errorf("%q is not an IP address", item)
+			}
+		}
+		return items, nil
+	case TemplateCIDR:
+		if _, _, err := net.ParseCIDR(raw); err != nil {
+			return nil, errors.New("must be a network in CIDR notation")
+		}
+		return raw, nil
+	case TemplateStringList:
+		return splitList(raw), nil
+	}
+	return raw, nil
+}
+
+// resolveValues validates the given values against the manifest and fills in defaults.
+func (t *TunnelTemplate) resolveValues(tunnelName string, values map[string]string) (map[string]interface{}, error) {
+	var problems []string
+	resolved := map[string]interface{}{templateTunnelNameVar: tunnelName}
+
+	declared := make(map[string]bool)
+	for _, v := range t.Manifest.Variables {
+		declared[v.Name] = true
+
+		raw, ok := values[v.Name]
+		if !ok || raw == "" {
+			raw = v.Default
+		}
+		if raw == "" {
+			if v.Required {
+				problems = append(problems, fmt.Sprintf("%s is required", v.Name))
+				continue
+			}
+			if v.Type == TemplateIPList || v.Type == TemplateStringList {
+				resolved[v.Name] = []string{}
+			} else {
+				resolved[v.Name] = nil
+			}
+			continue
+		}
+
+		value, err := v.parseValue(raw)
+		if err != nil {
+			problems = append(problems, fmt.Sprintf("%s %s", v.Name, err))
+			continue
+		}
+		resolved[v.Name] = value
+	}
+
+	for name := range values {
+		if !declared[name] {
+			problems = append(problems, fmt.Sprintf("%s is not a variable of this template", name))
+		}
+	}
+	if len(problems) > 0 {
+		sort.Strings(problems)
+		return nil, &TemplateError{Template: t.Name, Problems: problems}
+	}
+	return resolved, nil
+}
+
+// templateRawValue is how a value reads inside a larger string: lists are joined by commas and unset values are
+// empty.
+func templateRawValue(value interface{}) string {
+	switch v := value.(type) {
+	case nil:
+		return ""
+	case []string:
+		return strings.Join(v, ",")
+	}
+	return fmt.Sprint(value)
+}
+
+// templateRenderer substitutes placeholders and remembers the first undeclared variable it comes across.
+type templateRenderer struct {
+	name   string
+	values map[string]interface{}
+	err    error
+}
+
+func (r *templateRenderer) lookup(varName string) (interface{}, bool) {
+	value, ok := r.values[varName]
+	if !ok && r.err == nil {
+		r.err = fmt.Errorf("%s uses undeclared variable %s", r.name, varName)
+	}
+	return value, ok
+}
+
+// substitute replaces the placeholders in s with their raw values, escaped by escape.
+func (r *templateRenderer) substitute(s []byte, escape func(string) string) []byte {
+	return templatePlaceholder.ReplaceAllFunc(s, func(placeholder []byte) []byte {
+		value, ok := r.lookup(string(templatePlaceholder.FindSubmatch(placeholder)[1]))
+		if !ok {
+			return placeholder
+		}
+		return []byte(escape(templateRawValue(value)))
+	})
+}
+
+// renderYAMLNode replaces a plain scalar that is nothing but a placeholder with the value as YAML, so lists become
+// sequences and numbers stay numbers. Placeholders in quoted scalars or next to other text are replaced by the raw
+// value, keeping the scalar a string.
+func (r *templateRenderer) renderYAMLNode(n *yaml.Node) {
+	for _, child := range n.Content {
+		r.renderYAMLNode(child)
+	}
+	raw := func(s string) string { return s }
+	for _, comment := range []*string{&n.HeadComment, &n.LineComment, &n.FootComment} {
+		*comment = string(r.substitute([]byte(*comment), raw))
+	}
+	if n.Kind != yaml.ScalarNode || !templatePlaceholder.MatchString(n.Value) {
+		return
+	}
+
+	loc := templatePlaceholder.FindStringSubmatchIndex(n.Value)
+	if n.Style == 0 && loc[0] == 0 && loc[1] == len(n.Value) {
+		value, ok := r.lookup(n.Value[loc[2]:loc[3]])
+		if !ok {
+			return
+		}
+		encoded, err := yaml.Marshal(value)
+		var doc yaml.Node
+		if err == nil {
+			err = yaml.Unmarshal(encoded, &doc)
+		}
+		if err != nil || len(doc.Content) == 0 {
+			if r.err == nil {
+				r.err = fmt.Errorf("%s: could not encode %s: %v", r.name, n.Value, err)
+			}
+			return
+		}
+		replacement := *doc.Content[0]
+		if replacement.Kind != yaml.ScalarNode {
+			// Stay on the line of the placeholder
+			replacement.Style = yaml.FlowStyle
+		}
+		replacement.HeadComment, replacement.LineComment, replacement.FootComment = n.HeadComment, n.LineComment, n.FootComment
+		*n = replacement
+		return
+	}
+
+	n.Value = string(r.substitute([]byte(n.Value), raw))
+	n.Tag = "!!str"
+}
+
+// renderJSON replaces placeholders inside string literals with the escaped raw value and everywhere else with the
+// JSON encoding of the value.
+func (r *templateRenderer) renderJSON(contents []byte) []byte {
+	var out bytes.Buffer
+	inString := false
+	for i := 0; i < len(contents); {
+		if loc := templatePlaceholder.FindSubmatchIndex(contents[i:]); loc != nil && loc[0] == 0 {
+			placeholder := contents[i : i+loc[1]]
+			i += loc[1]
+			if inString {
+				out.Write(r.substitute(placeholder, func(s string) string {
+					quoted, _ := json.Marshal(s)
+					return string(quoted[1 : len(quoted)-1])
+				}))
+				continue
+			}
+			value, ok := r.lookup(string(placeholder[loc[2]:loc[3]]))
+			if !ok {
+				out.Write(placeholder)
+				continue
+			}
+			encoded, err := json.Marshal(value)
+			if err != nil && r.err == nil {
+				r.err = err
+			}
+			out.Write(encoded)
+			continue
+		}
+
+		c := contents[i]
+		if inString && c == '\\' && i+1 < len(contents) {
+			out.Write(contents[i : i+2])
+			i += 2
+			continue
+		}
+		if c == '"' {
+			inString = !inString
+		}
+		out.WriteByte(c)
+		i++
+	}
+	return out.Bytes()
+}
+
+// renderTemplateFile fills in the placeholders of a YAML or JSON template file.
+func renderTemplateFile(name string, contents []byte, values map[string]interface{}) ([]byte, error) {
+	r := &templateRenderer{name: name, values: values}
+	if !isYAMLFile(name) {
+		rendered := r.renderJSON(contents)
+		if r.err != nil {
+			return nil, r.err
+		}
+		return rendered, nil
+	}
+
+	var doc yaml.Node
+	if err := yaml.Unmarshal(contents, &doc); err != nil {
+		return nil, fmt.Errorf("%s is not valid YAML: %s", name, err)
+	}
+	r.renderYAMLNode(&doc)
+	if r.err != nil {
+		return nil, r.err
+	}
+	return encodeYAML(&doc)
+}
+
+// Render creates a new tunnel named tunnelName under root from the template. Values are given as strings and
+// validated against the types in the template manifest.
+func (t *TunnelTemplate) Render(root string, tunnelName string, values map[string]string) error {
+	tunnelPath, err := TunnelPath(root, tunnelName)
+	if err != nil {
+		return err
+	}
+	if tunnelName != SanitizeTunnelName(tunnelName) {
+		return fmt.Errorf("invalid tunnel name %q", tunnelName)
+	}
+	if _, err := os.Stat(tunnelPath); err == nil {
+		return fmt.Errorf("tunnel %s already exists", tunnelName)
+	}
+
+	resolved, err := t.resolveValues(tunnelName, values)
+	if err != nil {
+		return err
+	}
+
+	entries, err := ioutil.ReadDir(t.Path)
+	if err != nil {
+		return err
+	}
+	files := make(map[string][]byte)
+	for _, e := range entries {
+		if !e.Mode().IsRegular() || e.Name() == templateManifestName {
+			continue
+		}
+		if e.Size() > maxTemplateFileSize {
+			return fmt.Errorf("template file %s is too large", e.Name())
+		}
+		contents, err := ioutil.ReadFile(filepath.Join(t.Path, e.Name()))
+		if err != nil {
+			return err
+		}
+		if isYAMLFile(e.Name()) || strings.EqualFold(filepath.Ext(e.Name()), ".json") {
+			contents, err = renderTemplateFile(e.Name(), contents, resolved)
+			if err != nil {
+				return err
+			}
+		}
+		files[e.Name()] = contents
+	}
+
+	if metadataBytes, ok := files[metadataFileName]; ok {
+		_, _, err = parseTunnelMetadata(metadataFileName, metadataBytes)
+		if err != nil {
+			return err
+		}
+	}
+
+	return writeTunnelDir(root, tunnelName, files)
+}
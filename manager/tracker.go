@@ -0,0 +1,268 @@
+package manager
+
+import (
+	"errors"
+	"fmt"
+	"golang.org/x/sys/windows"
+	"golang.org/x/sys/windows/svc"
+	"golang.org/x/sys/windows/svc/mgr"
+	"golang.zx2c4.com/wireguard/windows/services"
+	"log"
+	"strings"
+	"sync"
+	"time"
+)
+
+const trackerPollInterval = time.Second
+
+type trackedTunnel struct {
+	tunnel Tunnel
+	state  TunnelState
+}
+
+var (
+	trackedTunnels     = make(map[string]*trackedTunnel)
+	trackedTunnelsLock sync.Mutex
+)
+
+// QueryTunnelState combines the Windows service state of a tunnel with the readiness reported by the tunnel
+// service itself. A tunnel whose service exited with an error is stopped and reports the error.
+func QueryTunnelState(tunnelName string, configPath string) (TunnelState, error) {
+	m, err := mgr.Connect()
+	if err != nil {
+		return TunnelUnknown, err
+	}
+	defer m.Disconnect()
+
+	service, err := m.OpenService(fmt.Sprintf("Nebula_%s", tunnelName))
+	if err != nil {
+		return TunnelStopped, nil
+	}
+	defer service.Close()
+
+	status, err := service.Query()
+	if err != nil {
+		return TunnelUnknown, err
+	}
+
+	switch status.State {
+	case svc.StartPending:
+		return TunnelStarting, nil
+	case svc.StopPending:
+		return TunnelStopping, nil
+	case svc.Running:
+		tunnelStatus, err := ReadTunnelStatus(configPath)
+		if err != nil {
+			return TunnelStarting, nil
+		}
+		if tunnelStatus.State == TunnelDegraded && tunnelStatus.Error != "" {
+			return TunnelDegraded, errors.New(tunnelStatus.Error)
+		}
+		return tunnelStatus.State, nil
+	}
+	// Stopping a tunnel removes its service, so a stopped service that is still there exited on its own
+	if status.Win32ExitCode != windows.NO_ERROR {
+		if status.Win32ExitCode == uint32(windows.ERROR_SERVICE_SPECIFIC_ERROR) {
+			return TunnelStopped, services.Error(status.ServiceSpecificExitCode)
+		}
+		return TunnelStopped, fmt.Errorf("tunnel service failed: %s", windows.Errno(status.Win32ExitCode))
+	}
+	return TunnelStopped, nil
+}
+
+func trackTunnel(t Tunnel) {
+	trackedTunnelsLock.Lock()
+	trackedTunnels[t.Name] = &trackedTunnel{
+		tunnel: t,
+		state:  TunnelStarting,
+	}
+	trackedTunnelsLock.Unlock()
+
+	log.Printf("Tracking tunnel %s", &t)
+	IPCServerNotifyTunnelChange(t.Name, TunnelStarting, nil)
+}
+
+func untrackTunnel(tunnelName string) {
+	trackedTunnelsLock.Lock()
+	_, ok := trackedTunnels[tunnelName]
+	delete(trackedTunnels, tunnelName)
+	trackedTunnelsLock.Unlock()
+
+	if ok {
+		IPCServerNotifyTunnelChange(tunnelName, TunnelStopped, nil)
+	}
+}
+
+// tunnelServicePath returns the config path a tunnel service was installed with.
+func tunnelServicePath(service *mgr.Service) (string, error) {
+	config, err := service.Config()
+	if err != nil {
+		return "", err
+	}
+	args, err := windows.DecomposeCommandLine(config.BinaryPathName)
+	if err != nil {
+		return "", err
+	}
+	for i := 0; i+1 < len(args); i++ {
+		if args[i] == "-tunnel" {
+			return args[i+1], nil
+		}
+	}
+	return "", fmt.Errorf("service %s does not run a tunnel", service.Name)
+}
+
+// adoptTunnel starts tracking a tunnel whose service runs without this manager having started it, such as one started
+// before the manager restarted. It returns the config path of the tunnel, or false if it has no running service.
+func adoptTunnel(tunnelName string) (string, bool) {
+	if configPath, ok := trackedTunnelPath(tunnelName); ok {
+		return configPath, true
+	}
+
+	m, err := mgr.Connect()
+	if err != nil {
+		return "", false
+	}
+	defer m.Disconnect()
+
+	service, err := m.OpenService(fmt.Sprintf("Nebula_%s", tunnelName))
+	if err != nil {
+		return "", false
+	}
+	defer service.Close()
+
+	status, err := service.Query()
+	if err != nil || status.State == svc.Stopped {
+		return "", false
+	}
+	configPath, err := tunnelServicePath(service)
+	if err != nil {
+		log.Printf("Not tracking %s: %v", tunnelName, err)
+		return "", false
+	}
+
+	state, _ := QueryTunnelState(tunnelName, configPath)
+	t := Tunnel{
+		Path:        configPath,
+		Name:        tunnelName,
+		DisplayName: TunnelDisplayName(configPath),
+		State:       state,
+	}
+	trackedTunnelsLock.Lock()
+	if existing, ok := trackedTunnels[tunnelName]; ok {
+		trackedTunnelsLock.Unlock()
+		return existing.tunnel.Path, true
+	}
+	trackedTunnels[tunnelName] = &trackedTunnel{tunnel: t, state: state}
+	trackedTunnelsLock.Unlock()
+
+	Tunnels.Put(t)
+	log.Printf("Tracking tunnel %s, which was already %s", &t, state)
+	return configPath, true
+}
+
+// adoptRunningTunnels tracks every tunnel service that is running when the manager starts.
+func adoptRunningTunnels() {
+	m, err := mgr.Connect()
+	if err != nil {
+		log.Printf("Unable to list tunnel services: %v", err)
+		return
+	}
+	names, err := m.ListServices()
+	m.Disconnect()
+	if err != nil {
+		log.Printf("Unable to list tunnel services: %v", err)
+		return
+	}
+
+	for _, name := range names {
+		if strings.HasPrefix(name, "Nebula_") {
+			adoptTunnel(strings.TrimPrefix(name, "Nebula_"))
+		}
+	}
+}
+
+func trackedTunnelPath(tunnelName string) (string, bool) {
+	trackedTunnelsLock.Lock()
+	defer trackedTunnelsLock.Unlock()
+
+	t, ok := trackedTunnels[tunnelName]
+	if !ok {
+		return "", false
+	}
+	return t.tunnel.Path, true
+}
+
+// trackedRunningTunnels returns the tracked tunnels that are not stopped.
+func trackedRunningTunnels() []Tunnel {
+	trackedTunnelsLock.Lock()
+	defer trackedTunnelsLock.Unlock()
+
+	var tunnels []Tunnel
+	for _, t := range trackedTunnels {
+		if t.state != TunnelStopped {
+			tunnels = append(tunnels, t.tunnel)
+		}
+	}
+	return tunnels
+}
+
+func trackedGlobalState() TunnelState {
+	trackedTunnelsLock.Lock()
+	defer trackedTunnelsLock.Unlock()
+
+	global := TunnelStopped
+	for _, t := range trackedTunnels {
+		switch t.state {
+		case TunnelStarting, TunnelStopping:
+			return t.state
+		case TunnelStarted, TunnelDegraded:
+			global = TunnelStarted
+		}
+	}
+	return global
+}
+
+func pollTrackedTunnels() {
+	trackedTunnelsLock.Lock()
+	tunnels := make([]Tunnel, 0, len(trackedTunnels))
+	for _, t := range trackedTunnels {
+		tunnels = append(tunnels, t.tunnel)
+	}
+	trackedTunnelsLock.Unlock()
+
+	for i := range tunnels {
+		name := tunnels[i].Name
+		state, stateErr := QueryTunnelState(name, tunnels[i].Path)
+		if state == TunnelUnknown {
+			continue
+		}
+
+		trackedTunnelsLock.Lock()
+		t, ok := trackedTunnels[name]
+		changed := ok && t.state != state
+		if changed {
+			t.state = state
+		}
+		trackedTunnelsLock.Unlock()
+
+		if changed {
+			log.Printf("Tunnel %s is now %s", &tunnels[i], state)
+			IPCServerNotifyTunnelChange(name, state, stateErr)
+		}
+	}
+}
+
+func runTunnelTracker(stop <-chan struct{}) {
+	adoptRunningTunnels()
+	ticker := time.NewTicker(trackerPollInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-stop:
+			return
+		case <-ticker.C:
+			pollTrackedTunnels()
+		}
+	}
+}
@@ -116,6 +116,7 @@ func (service *tunnelService) Execute(args []string, r <-chan svc.ChangeRequest,
 	f, err := os.OpenFile(fmt.Sprintf("%s\\tunnel.log", service.configPath), os.O_RDWR|os.O_CREATE|os.O_APPEND, 0666)
 	if err != nil {
 		fmt.Printf("error opening file: %v", err)
+		serviceError = services.ErrorRingloggerOpen
 		return
 	}
 	defer f.Close()
@@ -126,6 +127,7 @@ func (service *tunnelService) Execute(args []string, r <-chan svc.ChangeRequest,
 	err = os.Chdir(service.configPath)
 	if err != nil {
 		l.Printf("failed to change working directory to %s -- %s. Config may be broken\n", service.configPath, err)
+		serviceError = services.ErrorLoadConfiguration
 		return
 	}
 
@@ -134,16 +136,28 @@ func (service *tunnelService) Execute(args []string, r <-chan svc.ChangeRequest,
 	err = config.Load(service.configPath)
 	if err != nil {
 		l.Printf("failed to load config: %s\n", err)
+		serviceError = services.ErrorLoadConfiguration
 		return
 	}
 
 	nebulaTun, err := nebula.Main(config, false, "0.1", l, nil)
 	if err != nil {
 		l.Printf("failed to start tunnel: %s\n", err)
+		serviceError = services.ErrorDeviceBringUp
 		return
 	}
 
-	go nebulaTun.Start()
+	nebulaTun.Start()
+
+	md, err := LoadTunnelMetadata(service.configPath)
+	if err != nil {
+		l.Printf("ignoring tunnel metadata: %s\n", err)
+		err = nil
+	}
+	sessionPolicy := md.Session()
+
+	readiness := newReadinessMonitor(nebulaTun, config, service.configPath, l)
+	go readiness.run()
 
 	changes <- svc.Status{State: svc.Running, Accepts: svc.AcceptStop | svc.AcceptSessionChange}
 
@@ -165,6 +179,9 @@ loop:
 					log.Printf("Unexpected size of WTSSESSION_NOTIFICATION: %d", sessionNotification.Size)
 					continue
 				}
+				if sessionPolicy == SessionPolicyAlways {
+					continue
+				}
 				if c.EventType == windows.WTS_SESSION_LOGOFF {
 					//stop tunnel
 					nebulaTun.Stop()
@@ -180,6 +197,7 @@ loop:
 	}
 
 	changes <- svc.Status{State: svc.StopPending}
+	readiness.Stop()
 	nebulaTun.Stop()
 
 	return
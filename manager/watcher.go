@@ -0,0 +1,315 @@
+package manager
+
+import (
+	"golang.org/x/sys/windows"
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+	"unsafe"
+)
+
+const (
+	watcherPollInterval = 10 * time.Second
+	watcherDebounce     = 500 * time.Millisecond
+)
+
+var watchedConfigExtensions = map[string]bool{
+	".yml":  true,
+	".yaml": true,
+	".crt":  true,
+	".key":  true,
+	".json": true,
+}
+
+// TunnelsDiff lists tunnel directories that were added or removed, tunnels whose nebula config changed and tunnels
+// where only metadata.json changed.
+type TunnelsDiff struct {
+	Added           []string
+	Removed         []string
+	Modified        []string
+	MetadataChanged []string
+}
+
+func (d *TunnelsDiff) Empty() bool {
+	return len(d.Added) == 0 && len(d.Removed) == 0 && len(d.Modified) == 0 && len(d.MetadataChanged) == 0
+}
+
+// TunnelsChanged reports whether the list of tunnels or their names changed, as opposed to only their configs.
+func (d *TunnelsDiff) TunnelsChanged() bool {
+	return len(d.Added) > 0 || len(d.Removed) > 0 || len(d.MetadataChanged) > 0
+}
+
+type tunnelSnapshot map[string]map[string]time.Time
+
+// ConfigWatcher watches a tunnel config root for tunnel directories being added or removed and for edits to the
+// config files inside them. Directory change notifications are used when available, with periodic rescans as a
+// fallback for anything they miss. Changes to other files, such as logs and status files, are ignored.
+type ConfigWatcher struct {
+	root      string
+	onChange  func(TunnelsDiff)
+	known     tunnelSnapshot
+	stopEvent windows.Handle
+	done      chan struct{}
+}
+
+func isWatchedConfigFile(name string) bool {
+	if name == statusFileName {
+		return false
+	}
+	return watchedConfigExtensions[strings.ToLower(filepath.Ext(name))]
+}
+
+func scanTunnelConfigs(root string) tunnelSnapshot {
+	snapshot := make(tunnelSnapshot)
+
+	dirs, err := ioutil.ReadDir(root)
+	if err != nil {
+		return snapshot
+	}
+
+	for _, d := range dirs {
+		if !d.IsDir() || strings.HasPrefix(d.Name(), ".") {
+			continue
+		}
+		files := make(map[string]time.Time)
+		entries, err := ioutil.ReadDir(filepath.Join(root, d.Name()))
+		if err == nil {
+			for _, f := range entries {
+				if !f.IsDir() && isWatchedConfigFile(f.Name()) {
+					files[f.Name()] = f.ModTime()
+				}
+			}
+		}
+		snapshot[d.Name()] = files
+	}
+	return snapshot
+}
+
+func diffTunnelSnapshots(before tunnelSnapshot, after tunnelSnapshot) TunnelsDiff {
+	var diff TunnelsDiff
+
+	for name, files := range after {
+		oldFiles, ok := before[name]
+		if !ok {
+			diff.Added = append(diff.Added, name)
+			continue
+		}
+		configChanged, metadataChanged := false, false
+		for f, modTime := range files {
+			if oldModTime, ok := oldFiles[f]; !ok || !oldModTime.Equal(modTime) {
+				if f == metadataFileName {
+					metadataChanged = true
+				} else {
+					configChanged = true
+				}
+			}
+		}
+		for f := range oldFiles {
+			if _, ok := files[f]; !ok {
+				if f == metadataFileName {
+					metadataChanged = true
+				} else {
+					configChanged = true
+				}
+			}
+		}
+		if configChanged {
+			diff.Modified = append(diff.Modified, name)
+		}
+		if metadataChanged {
+			diff.MetadataChanged = append(diff.MetadataChanged, name)
+		}
+	}
+	for name := range before {
+		if _, ok := after[name]; !ok {
+			diff.Removed = append(diff.Removed, name)
+		}
+	}
+
+	sort.Strings(diff.Added)
+	sort.Strings(diff.Removed)
+	sort.Strings(diff.Modified)
+	sort.Strings(diff.MetadataChanged)
+	return diff
+}
+
+func NewConfigWatcher(root string, onChange func(TunnelsDiff)) (*ConfigWatcher, error) {
+	stopEvent, err := windows.CreateEvent(nil, 1, 0, nil)
+	if err != nil {
+		return nil, err
+	}
+
+	return &ConfigWatcher{
+		root:      root,
+		onChange:  onChange,
+		known:     scanTunnelConfigs(root),
+		stopEvent: stopEvent,
+		done:      make(chan struct{}),
+	}, nil
+}
+
+func (w *ConfigWatcher) rescan() {
+	current := scanTunnelConfigs(w.root)
+	diff := diffTunnelSnapshots(w.known, current)
+	w.known = current
+
+	if !diff.Empty() {
+		log.Printf("Tunnel configs changed: added %v, removed %v, modified %v, metadata changed %v", diff.Added, diff.Removed, diff.Modified, diff.MetadataChanged)
+		w.onChange(diff)
+	}
+}
+
+// poll rescans until the watcher is stopped, which it reports, or until the root exists if untilCreated is set so
+// that notifications can be used again.
+func (w *ConfigWatcher) poll(untilCreated bool) bool {
+	for {
+		event, _ := windows.WaitForSingleObject(w.stopEvent, uint32(watcherPollInterval.Milliseconds()))
+		if event == windows.WAIT_OBJECT_0 {
+			return true
+		}
+		w.rescan()
+		if _, err := os.Stat(w.root); untilCreated && err == nil {
+			return false
+		}
+	}
+}
+
+// isTunnelConfigChange reports whether a path reported by ReadDirectoryChanges, relative to the root, can change the
+// tunnels. Logs and the status file the tunnel service rewrites every second are not config and must not trigger
+// rescans.
+func isTunnelConfigChange(name string) bool {
+	parts := strings.Split(name, `\`)
+	if strings.HasPrefix(parts[0], ".") {
+		return false
+	}
+	switch len(parts) {
+	case 1:
+		return true
+	case 2:
+		return isWatchedConfigFile(parts[1])
+	}
+	return false
+}
+
+func hasTunnelConfigChange(buf []byte) bool {
+	for offset := uint32(0); offset < uint32(len(buf)); {
+		info := (*windows.FileNotifyInformation)(unsafe.Pointer(&buf[offset]))
+		n := int(info.FileNameLength / 2)
+		name := windows.UTF16ToString((*[1 << 15]uint16)(unsafe.Pointer(&info.FileName))[:n:n])
+		if isTunnelConfigChange(name) {
+			return true
+		}
+		if info.NextEntryOffset == 0 {
+			break
+		}
+		offset += info.NextEntryOffset
+	}
+	return false
+}
+
+// watch waits on directory change notifications. It returns false if notifications stop working and the watcher
+// needs to fall back to polling.
+func (w *ConfigWatcher) watch() bool {
+	root, err := windows.UTF16PtrFromString(w.root)
+	if err != nil {
+		return false
+	}
+	dir, err := windows.CreateFile(root, windows.FILE_LIST_DIRECTORY,
+		windows.FILE_SHARE_READ|windows.FILE_SHARE_WRITE|windows.FILE_SHARE_DELETE, nil, windows.OPEN_EXISTING,
+		windows.FILE_FLAG_BACKUP_SEMANTICS|windows.FILE_FLAG_OVERLAPPED, 0)
+	if err != nil {
+		log.Printf("Unable to watch %s, falling back to polling: %v", w.root, err)
+		return false
+	}
+	defer windows.CloseHandle(dir)
+
+	changed, err := windows.CreateEvent(nil, 1, 0, nil)
+	if err != nil {
+		log.Printf("Unable to watch %s, falling back to polling: %v", w.root, err)
+		return false
+	}
+	defer windows.CloseHandle(changed)
+
+	// The buffer must stay in place while a read is pending, so a pending read is cancelled and waited for before
+	// returning
+	buf := make([]byte, 64*1024)
+	var overlapped windows.Overlapped
+	pending := false
+	defer func() {
+		if pending {
+			var n uint32
+			windows.CancelIo(dir)
+			windows.GetOverlappedResult(dir, &overlapped, &n, true)
+		}
+	}()
+
+	for {
+		if !pending {
+			overlapped = windows.Overlapped{HEvent: changed}
+			err = windows.ReadDirectoryChanges(dir, &buf[0], uint32(len(buf)), true,
+				windows.FILE_NOTIFY_CHANGE_DIR_NAME|windows.FILE_NOTIFY_CHANGE_FILE_NAME|windows.FILE_NOTIFY_CHANGE_LAST_WRITE,
+				nil, &overlapped, 0)
+			if err != nil {
+				log.Printf("Unable to watch %s, falling back to polling: %v", w.root, err)
+				return false
+			}
+			pending = true
+		}
+
+		event, err := windows.WaitForMultipleObjects([]windows.Handle{changed, w.stopEvent}, false, uint32(watcherPollInterval.Milliseconds()))
+		if err != nil {
+			log.Printf("Waiting for changes in %s failed, falling back to polling: %v", w.root, err)
+			return false
+		}
+		switch event {
+		case windows.WAIT_OBJECT_0:
+			pending = false
+			var n uint32
+			err = windows.GetOverlappedResult(dir, &overlapped, &n, false)
+			if err != nil {
+				log.Printf("Reading changes in %s failed, falling back to polling: %v", w.root, err)
+				return false
+			}
+			// Nothing is returned when more changed than fits in the buffer
+			if n == 0 || hasTunnelConfigChange(buf[:n]) {
+				time.Sleep(watcherDebounce)
+				w.rescan()
+			}
+		case windows.WAIT_OBJECT_0 + 1:
+			return true
+		default:
+			w.rescan()
+		}
+	}
+}
+
+func (w *ConfigWatcher) Start() {
+	go func() {
+		defer close(w.done)
+		for !w.watch() {
+			// A root that does not exist yet is watched once it is created
+			_, err := os.Stat(w.root)
+			if w.poll(os.IsNotExist(err)) {
+				return
+			}
+		}
+	}()
+}
+
+func (w *ConfigWatcher) Stop() {
+	windows.SetEvent(w.stopEvent)
+	<-w.done
+	windows.CloseHandle(w.stopEvent)
+}
+
+type ConfigWatchers []*ConfigWatcher
+
+func (ws ConfigWatchers) Stop() {
+	for _, w := range ws {
+		w.Stop()
+	}
+}
@@ -0,0 +1,124 @@
+package ui
+
+import (
+	"fmt"
+	"github.com/slackhq/nebula/cert"
+	"golang.org/x/sys/windows"
+	"log"
+	"nebula-windows-ui/manager"
+	"sort"
+	"strings"
+)
+
+// CAChangeError is returned when a controller hands out Nebula CAs that share none of the pinned ones. A controller
+// rotating its CA lists the old and the new CA together until every node has picked up the new one.
+type CAChangeError struct {
+	Pinned    []string
+	Presented []string
+}
+
+func (e *CAChangeError) Error() string {
+	return fmt.Sprintf("the controller replaced the trusted Nebula CA %s with %s without listing them together for a rotation",
+		strings.Join(e.Pinned, ", "), strings.Join(e.Presented, ", "))
+}
+
+// caPinChange is what accepting the CAs of a controller response does to the pinned CAs of a tunnel.
+type caPinChange struct {
+	Pinned  []string
+	Added   []string
+	Removed []string
+	Names   map[string]string
+}
+
+func (c *caPinChange) describe(fingerprints []string) string {
+	s := make([]string, 0, len(fingerprints))
+	for _, fingerprint := range fingerprints {
+		s = append(s, fmt.Sprintf("%s (%s)", c.Names[fingerprint], fingerprint))
+	}
+	return strings.Join(s, "\n")
+}
+
+// caFingerprints parses a PEM bundle of Nebula CAs and returns their fingerprints, sorted, and names.
+func caFingerprints(caPEM string) ([]string, map[string]string, error) {
+	pool, err := cert.NewCAPoolFromBytes([]byte(caPEM))
+	if err != nil {
+		return nil, nil, fmt.Errorf("controller CA is unusable: %s", err)
+	}
+	fingerprints := make([]string, 0, len(pool.CAs))
+	names := make(map[string]string, len(pool.CAs))
+	for fingerprint, ca := range pool.CAs {
+		fingerprints = append(fingerprints, fingerprint)
+		names[fingerprint] = ca.Details.Name
+	}
+	sort.Strings(fingerprints)
+	return fingerprints, names, nil
+}
+
+// checkControllerCA compares the CAs a controller hands out with the pinned ones. New CAs are only accepted next to a
+// pinned one, CAs the controller stops listing are unpinned. Without pinned CAs the presented ones are pinned as is.
+func checkControllerCA(pinned []string, caPEM string) (*caPinChange, error) {
+	presented, names, err := caFingerprints(caPEM)
+	if err != nil {
+		return nil, err
+	}
+
+	change := &caPinChange{Pinned: presented, Names: names}
+	wasPinned := make(map[string]bool, len(pinned))
+	for _, fingerprint := range pinned {
+		wasPinned[fingerprint] = true
+	}
+	isPresented := make(map[string]bool, len(presented))
+	overlap := false
+	for _, fingerprint := range presented {
+		isPresented[fingerprint] = true
+		if wasPinned[fingerprint] {
+			overlap = true
+		} else {
+			change.Added = append(change.Added, fingerprint)
+		}
+	}
+	for _, fingerprint := range pinned {
+		if !isPresented[fingerprint] {
+			change.Removed = append(change.Removed, fingerprint)
+		}
+	}
+
+	if len(pinned) > 0 && !overlap {
+		return nil, &CAChangeError{Pinned: pinned, Presented: presented}
+	}
+	return change, nil
+}
+
+// verifyControllerCA makes sure the CA a controller hands out for a tunnel is one the tunnel trusts, warns the user
+// about a rotation and records the CAs that are pinned afterwards.
+func verifyControllerCA(t manager.Tunnel, md *manager.ConfigMetadata, caPEM string) error {
+	change, err := checkControllerCA(md.CAFingerprints, caPEM)
+	if err != nil {
+		return err
+	}
+
+	if len(md.CAFingerprints) == 0 {
+		log.Printf("Pinned the Nebula CA of %s to %s\n", &t, strings.Join(change.Pinned, ", "))
+	} else if len(change.Added) > 0 {
+		msg := fmt.Sprintf("The controller of %s is rotating its Nebula CA. It lists the new CA\n%s\n\ntogether with the CA this tunnel trusts\n%s\n\nso the new CA is trusted from now on. Contact your administrator if you did not expect this.",
+			t.Title(), change.describe(change.Added), strings.Join(md.CAFingerprints, "\n"))
+		windows.MessageBox(0, windows.StringToUTF16Ptr(msg), windows.StringToUTF16Ptr("Nebula"), windows.MB_ICONWARNING)
+		log.Printf("Nebula CA of %s rotating, added %s\n", &t, strings.Join(change.Added, ", "))
+	}
+	if len(md.CAFingerprints) > 0 && len(change.Removed) > 0 {
+		log.Printf("Nebula CA of %s rotated, removed %s\n", &t, strings.Join(change.Removed, ", "))
+	}
+	if len(change.Added) == 0 && len(change.Removed) == 0 {
+		return nil
+	}
+
+	err = manager.UpdateTunnelMetadata(t.Path, func(md *manager.ConfigMetadata) error {
+		md.CAFingerprints = change.Pinned
+		return nil
+	})
+	if err != nil {
+		return fmt.Errorf("could not record the Nebula CA: %s", err)
+	}
+	md.CAFingerprints = change.Pinned
+	return nil
+}
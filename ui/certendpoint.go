@@ -0,0 +1,153 @@
+package ui
+
+import (
+	"context"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/slackhq/nebula/cert"
+	"nebula-windows-ui/manager"
+	"net/http"
+	"net/url"
+	"time"
+)
+
+// errNoIssuedCert is returned when the controller has no certificate for our public key.
+var errNoIssuedCert = errors.New("controller has no certificate for this key")
+
+// CertResponse is what the controller's cert endpoint returns for a public key: the certificate it issued last,
+// along with what a sign response carries, and its current CA bundle.
+type CertResponse struct {
+	SignResponse
+	CA string `json:"ca"`
+}
+
+// fetchIssuedCert asks the controller for the certificate it issued for a public key.
+func fetchIssuedCert(ctx context.Context, client *http.Client, endpoint string, accessToken string, publicKey []byte) (*CertResponse, error) {
+	u, err := url.Parse(endpoint)
+	if err != nil {
+		return nil, err
+	}
+	query := u.Query()
+	query.Set("public_key", hex.EncodeToString(publicKey))
+	u.RawQuery = query.Encode()
+
+	req, err := http.NewRequestWithContext(ctx, "GET", u.String(), nil)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Add("Authorization", fmt.Sprintf("Bearer %s", accessToken))
+
+	resp, err := client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode == http.StatusNotFound {
+		return nil, errNoIssuedCert
+	}
+	if resp.StatusCode != http.StatusOK {
+		return nil, responseError("cert request", resp)
+	}
+
+	var certResponse CertResponse
+	err = json.NewDecoder(resp.Body).Decode(&certResponse)
+	if err != nil {
+		return nil, err
+	}
+	return &certResponse, nil
+}
+
+// checkIssuedCA returns the CA bundle the cert endpoint handed out, or the one of the controller config if it sent
+// none. It may only contain CAs the tunnel trusts already; rotations are announced through the controller config.
+func checkIssuedCA(nebulaConfig *NebulaConfig, md *manager.ConfigMetadata, caPEM string) (string, error) {
+	if caPEM == "" {
+		caPEM = nebulaConfig.CACert
+	}
+	var pinned []string
+	if md != nil {
+		pinned = md.CAFingerprints
+	}
+	change, err := checkControllerCA(pinned, caPEM)
+	if err != nil {
+		return "", err
+	}
+	if len(pinned) > 0 && len(change.Added) > 0 {
+		return "", fmt.Errorf("cert endpoint handed out CAs the controller did not announce: %s", change.describe(change.Added))
+	}
+	return caPEM, nil
+}
+
+// refreshCABundle asks the cert endpoint for the current CA bundle of the controller, for a tunnel that keeps its
+// certificate. The bundle is checked like one that comes with a recovered certificate and must still contain the CA
+// that signed certPEM.
+func refreshCABundle(ctx context.Context, client *http.Client, nebulaConfig *NebulaConfig, md *manager.ConfigMetadata, accessToken string, pubKeyBytes []byte, certPEM []byte) (string, error) {
+	pubKey, _, err := cert.UnmarshalX25519PublicKey(pubKeyBytes)
+	if err != nil {
+		return "", err
+	}
+	certResponse, err := fetchIssuedCert(ctx, client, nebulaConfig.CertEndpoint, accessToken, pubKey)
+	if err != nil {
+		return "", err
+	}
+	caPEM, err := checkIssuedCA(nebulaConfig, md, certResponse.CA)
+	if err != nil {
+		return "", err
+	}
+
+	nc, _, err := cert.UnmarshalNebulaCertificateFromPEM(certPEM)
+	if err != nil {
+		return "", err
+	}
+	pool, err := cert.NewCAPoolFromBytes([]byte(caPEM))
+	if err != nil {
+		return "", err
+	}
+	ca, err := pool.GetCAForCert(nc)
+	if err != nil || !nc.CheckSignature(ca.Details.PublicKey) {
+		return "", errors.New("refreshed CA bundle no longer contains the CA of the certificate")
+	}
+	return caPEM, nil
+}
+
+// recoverIssuedCert downloads the certificate the controller already issued for our key, for example after node.crt
+// was lost or corrupted, and returns it along with the CA bundle it chains to. The certificate is verified exactly like
+// a freshly signed one and is only returned while it is not due for renewal. The CA bundle is checked with
+// checkIssuedCA.
+func recoverIssuedCert(ctx context.Context, client *http.Client, nebulaConfig *NebulaConfig, md *manager.ConfigMetadata, accessToken string, pubKeyBytes []byte, now time.Time) (*SignResponse, string, error) {
+	pubKey, _, err := cert.UnmarshalX25519PublicKey(pubKeyBytes)
+	if err != nil {
+		return nil, "", err
+	}
+
+	certResponse, err := fetchIssuedCert(ctx, client, nebulaConfig.CertEndpoint, accessToken, pubKey)
+	if err != nil {
+		return nil, "", err
+	}
+
+	caPEM, err := checkIssuedCA(nebulaConfig, md, certResponse.CA)
+	if err != nil {
+		return nil, "", err
+	}
+
+	signReq := buildSignRequest(nebulaConfig, md, pubKeyBytes)
+	err = verifyIssuedCert(signReq, pubKey, caPEM, certResponse.BlockList, []byte(certResponse.Certificate), now)
+	if err != nil {
+		return nil, "", err
+	}
+
+	nc, _, err := cert.UnmarshalNebulaCertificateFromPEM([]byte(certResponse.Certificate))
+	if err != nil {
+		return nil, "", err
+	}
+	var renewBefore time.Duration
+	if md != nil && md.KeyPolicy != nil {
+		renewBefore = time.Duration(md.KeyPolicy.RenewBeforeSeconds) * time.Second
+	}
+	if certRenewalDue(nc, renewBefore, now) {
+		return nil, "", fmt.Errorf("issued certificate expires %s", nc.Details.NotAfter.Format(time.RFC3339))
+	}
+	return &certResponse.SignResponse, caPEM, nil
+}
@@ -0,0 +1,128 @@
+package ui
+
+import (
+	"bytes"
+	"fmt"
+	"github.com/slackhq/nebula/cert"
+	"time"
+)
+
+// Certificates may be backdated by the controller to tolerate clock skew.
+const signDurationTolerance = 5 * time.Minute
+
+type CertProblem int
+
+const (
+	CertInvalid CertProblem = iota
+	CertUntrusted
+	CertBlocked
+	CertWrongKey
+	CertNotValidNow
+	CertMismatch
+)
+
+func (p CertProblem) String() string {
+	switch p {
+	case CertUntrusted:
+		return "untrusted"
+	case CertBlocked:
+		return "blocked"
+	case CertWrongKey:
+		return "wrong key"
+	case CertNotValidNow:
+		return "not currently valid"
+	case CertMismatch:
+		return "request mismatch"
+	}
+	return "invalid"
+}
+
+// CertVerificationError is returned when a controller issues a certificate that must not be used.
+type CertVerificationError struct {
+	Problem CertProblem
+	Detail  string
+}
+
+func (e *CertVerificationError) Error() string {
+	return fmt.Sprintf("controller issued an unusable certificate (%s): %s", e.Problem, e.Detail)
+}
+
+func certError(problem CertProblem, format string, v ...interface{}) error {
+	return &CertVerificationError{Problem: problem, Detail: fmt.Sprintf(format, v...)}
+}
+
+// verifyIssuedCert checks a certificate returned by the controller before it is written to disk: it has to be
+// signed by the controller CA within the CA's constraints, be currently valid, belong to our public key and carry
+// what was requested.
+func verifyIssuedCert(signReq SignRequest, publicKey []byte, caPEM string, blockList []string, certPEM []byte, now time.Time) error {
+	nc, _, err := cert.UnmarshalNebulaCertificateFromPEM(certPEM)
+	if err != nil {
+		return certError(CertInvalid, "%s", err)
+	}
+	details := nc.Details
+	if details.IsCA {
+		return certError(CertInvalid, "%s is a CA certificate", details.Name)
+	}
+
+	pool, err := cert.NewCAPoolFromBytes([]byte(caPEM))
+	if err != nil {
+		return certError(CertUntrusted, "controller CA is unusable: %s", err)
+	}
+	for _, fingerprint := range blockList {
+		pool.BlocklistFingerprint(fingerprint)
+	}
+	if pool.IsBlocklisted(nc) {
+		return certError(CertBlocked, "%s is on the controller blocklist", details.Name)
+	}
+	signer, err := pool.GetCAForCert(nc)
+	if err != nil {
+		return certError(CertUntrusted, "%s", err)
+	}
+	if signer.Expired(now) {
+		return certError(CertUntrusted, "controller CA %s is expired", signer.Details.Name)
+	}
+	if !nc.CheckSignature(signer.Details.PublicKey) {
+		return certError(CertUntrusted, "signature does not match controller CA %s", signer.Details.Name)
+	}
+	if err := nc.CheckRootConstrains(signer); err != nil {
+		return certError(CertUntrusted, "%s", err)
+	}
+
+	if !bytes.Equal(details.PublicKey, publicKey) {
+		return certError(CertWrongKey, "public key of %s is not ours", details.Name)
+	}
+	if nc.Expired(now) {
+		return certError(CertNotValidNow, "valid from %s until %s", details.NotBefore.Format(time.RFC3339), details.NotAfter.Format(time.RFC3339))
+	}
+
+	if signReq.IP != "" {
+		requested, err := normalizeCIDRs([]string{signReq.IP})
+		if err != nil {
+			return certError(CertMismatch, "requested IP can not be compared: %s", err)
+		}
+		if !sameStrings(requested, ipNetStrings(details.Ips)) {
+			return certError(CertMismatch, "issued for %v instead of %s", ipNetStrings(details.Ips), signReq.IP)
+		}
+	} else if len(details.Ips) == 0 {
+		return certError(CertMismatch, "no IP was allocated")
+	}
+	if len(signReq.Groups) > 0 && !sameStrings(signReq.Groups, details.Groups) {
+		return certError(CertMismatch, "issued for groups %v instead of %v", details.Groups, signReq.Groups)
+	}
+	if len(signReq.Subnets) > 0 {
+		requested, err := normalizeCIDRs(signReq.Subnets)
+		if err != nil {
+			return certError(CertMismatch, "requested subnets can not be compared: %s", err)
+		}
+		if !sameStrings(requested, ipNetStrings(details.Subnets)) {
+			return certError(CertMismatch, "issued for subnets %v instead of %v", ipNetStrings(details.Subnets), signReq.Subnets)
+		}
+	}
+	if signReq.Duration > 0 {
+		requested := time.Duration(signReq.Duration)*time.Second + signDurationTolerance
+		if details.NotAfter.Sub(details.NotBefore) > requested {
+			return certError(CertMismatch, "valid until %s, longer than the requested %ds", details.NotAfter.Format(time.RFC3339), signReq.Duration)
+		}
+	}
+	return nil
+}
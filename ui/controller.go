@@ -2,6 +2,7 @@ package ui
 
 import (
 	"bytes"
+	"context"
 	"crypto/rand"
 	"encoding/json"
 	"fmt"
@@ -13,20 +14,23 @@ import (
 	"io"
 	"io/ioutil"
 	"log"
+	"nebula-windows-ui/manager"
 	"net/http"
 	"net/url"
 	"os"
 	"path"
 	"path/filepath"
+	"time"
 )
 
 type NebulaConfig struct {
-	CertEndpoint       string `json:"certEndpoint"`
-	OidcClientID       string `json:"oidcClientID"`
-	OidcConfigURL      string `json:"oidcConfigURL"`
-	SignEndpoint       string `json:"signEndpoint"`
-	NodeConfigEndpoint string `json:"nodeConfigEndpoint"`
-	CACert             string `json:"ca"`
+	CertEndpoint       string        `json:"certEndpoint"`
+	OidcClientID       string        `json:"oidcClientID"`
+	OidcConfigURL      string        `json:"oidcConfigURL"`
+	SignEndpoint       string        `json:"signEndpoint"`
+	NodeConfigEndpoint string        `json:"nodeConfigEndpoint"`
+	CACert             string        `json:"ca"`
+	SignDefaults       *SignDefaults `json:"signDefaults,omitempty"`
 }
 
 type SignResponse struct {
@@ -37,9 +41,11 @@ type SignResponse struct {
 }
 
 type SignRequest struct {
-	PublicKey string `json:"public_key"`
-	Duration  int    `json:"duration,omitempty"`
-	IP        string `json:"ip,omitempty"`
+	PublicKey string   `json:"public_key"`
+	Duration  int      `json:"duration,omitempty"`
+	IP        string   `json:"ip,omitempty"`
+	Groups    []string `json:"groups,omitempty"`
+	Subnets   []string `json:"subnets,omitempty"`
 }
 
 type PKIConfig struct {
@@ -102,56 +108,31 @@ func execElevatedManagerServiceInstaller() error {
 	return windows.ERROR_UNHANDLED_EXCEPTION // Not reached
 }
 
-func createTempKey(configDir string) (string, string) {
+// generateKeyPair creates a new X25519 keypair for a tunnel and returns the PEM encoded public and private key.
+func generateKeyPair() ([]byte, []byte, error) {
 	var pubkey, privkey [32]byte
 	if _, err := io.ReadFull(rand.Reader, privkey[:]); err != nil {
-		panic(err)
+		return nil, nil, err
 	}
 	curve25519.ScalarBaseMult(&pubkey, &privkey)
-
-	pubKeyPath := path.Join(configDir, "node.pub")
-
-	os.Remove(pubKeyPath)
-	err := ioutil.WriteFile(pubKeyPath, cert.MarshalX25519PublicKey(pubkey[:]), 0600)
-	if err != nil {
-		log.Fatalf("Could not save temp public key!")
-	}
-
-	privKeyPath := path.Join(configDir, "node.key")
-	os.Remove(privKeyPath)
-	err = ioutil.WriteFile(privKeyPath, cert.MarshalX25519PrivateKey(privkey[:]), 0600)
-	if err != nil {
-		log.Fatalf("error while writing out-key: %s", err)
-	}
-
-	log.Printf("Generated temp keypair %s/%s", pubKeyPath, privKeyPath)
-
-	return pubKeyPath, privKeyPath
+	return cert.MarshalX25519PublicKey(pubkey[:]), cert.MarshalX25519PrivateKey(privkey[:]), nil
 }
 
-func signPublicKey(nebulaConfig *NebulaConfig, accessToken string, pubKeyFile string) (*SignResponse, error) {
-
-	pubKeyBytes, err := os.ReadFile(pubKeyFile)
-
+func signPublicKey(ctx context.Context, client *http.Client, nebulaConfig *NebulaConfig, md *manager.ConfigMetadata, accessToken string, pubKeyBytes []byte) (*SignResponse, error) {
+	pubKey, _, err := cert.UnmarshalX25519PublicKey(pubKeyBytes)
 	if err != nil {
 		return nil, err
 	}
 
-	var signReq SignRequest
-	signReq.PublicKey = string(pubKeyBytes)
-	signReq.Duration = 36000
-	signReq.IP = "192.168.11.123/24" // TODO remove this
+	signReq := buildSignRequest(nebulaConfig, md, pubKeyBytes)
 
 	signReqJson, err := json.Marshal(signReq)
 	if err != nil {
 		return nil, err
 	}
 
-	client := &http.Client{}
-	req, err := http.NewRequest("POST", nebulaConfig.SignEndpoint, bytes.NewBuffer(signReqJson))
-
+	req, err := http.NewRequestWithContext(ctx, "POST", nebulaConfig.SignEndpoint, bytes.NewBuffer(signReqJson))
 	if err != nil {
-		fmt.Println(err)
 		return nil, err
 	}
 
@@ -160,119 +141,177 @@ func signPublicKey(nebulaConfig *NebulaConfig, accessToken string, pubKeyFile st
 
 	signResp, err := client.Do(req)
 	if err != nil {
-		fmt.Println(err)
 		return nil, err
 	}
 	defer signResp.Body.Close()
 
-	if signResp.StatusCode != 200 {
-		b, _ := io.ReadAll(signResp.Body)
-		log.Fatalf("%s", b)
+	if signResp.StatusCode != http.StatusOK {
+		return nil, responseError("sign request", signResp)
 	}
 
 	var signResponse SignResponse
 
 	err = json.NewDecoder(signResp.Body).Decode(&signResponse)
 	if err != nil {
-		fmt.Println(err)
+		return nil, err
+	}
+
+	err = verifyIssuedCert(signReq, pubKey, nebulaConfig.CACert, signResponse.BlockList, []byte(signResponse.Certificate), time.Now())
+	if err != nil {
 		return nil, err
 	}
 
 	return &signResponse, nil
 }
 
-func CreateTempConfig(accessToken string, configPath string, nebulaConfig *NebulaConfig) error {
-	pubKeyFile, privKeyFile := createTempKey(configPath)
-
-	signResponse, err := signPublicKey(nebulaConfig, accessToken, pubKeyFile)
-
-	certFilePath := filepath.Join(configPath, "node.crt")
-	os.Remove(certFilePath)
-	out, err := os.Create(certFilePath)
+// CreateTempConfig prepares the key, certificate and controller config of a tunnel according to plan. Everything it
+// generates is committed to the tunnel directory in one transaction together with the key state in its metadata; it
+// reports whether any artifact changed, in which case the previous generation can be restored with
+// manager.RollbackArtifacts.
+func CreateTempConfig(ctx context.Context, client *http.Client, accessToken string, configPath string, nebulaConfig *NebulaConfig, plan keyPlan) (bool, error) {
+	md, err := manager.LoadTunnelMetadata(configPath)
 	if err != nil {
-		return fmt.Errorf("Could not create certificate file!")
+		return false, err
 	}
-	out.WriteString(signResponse.Certificate)
-	out.Close()
 
-	caFilePath := filepath.Join(configPath, "ca.crt")
-	os.Remove(caFilePath)
-	out, err = os.Create(caFilePath)
-	if err != nil {
-		return fmt.Errorf("Could not create ca file!")
-	}
-	out.WriteString(nebulaConfig.CACert)
-	out.Close()
-
-	mnc := MinNodeConfig{
-		PKI: PKIConfig{
-			CA:        filepath.Base(caFilePath),
-			Cert:      filepath.Base(certFilePath),
-			Key:       filepath.Base(privKeyFile),
-			BlockList: signResponse.BlockList,
-		},
-		StaticHosts: signResponse.StaticHosts,
-		Lighthouse: LighthouseConfig{
-			AmLighthouse: false,
-			Hosts:        signResponse.LightHouses,
-		},
-	}
+	tx := manager.NewArtifactTransaction(configPath)
+	tx.Put("ca.crt", []byte(nebulaConfig.CACert))
 
-	controllerSetConfigPath := filepath.Join(configPath, "zz_controller_config.yml")
-	os.Remove(controllerSetConfigPath)
-	out, err = os.Create(controllerSetConfigPath)
+	var pubKeyBytes []byte
+	if plan.Key == KeyReused {
+		pubKeyBytes, err = ioutil.ReadFile(filepath.Join(configPath, pubKeyFileName))
+	} else {
+		var privKeyBytes []byte
+		pubKeyBytes, privKeyBytes, err = generateKeyPair()
+		if err == nil {
+			tx.Put(pubKeyFileName, pubKeyBytes)
+			tx.Put(keyFileName, privKeyBytes)
+			log.Printf("Generated keypair for %s\n", configPath)
+		}
+	}
 	if err != nil {
-		return fmt.Errorf("Could not create controller config set!")
+		return false, err
 	}
-	outBytes, err := yaml.Marshal(mnc)
-	out.Write(outBytes)
-	out.Close()
 
-	defaultConfigPath := filepath.Join(configPath, "default.yml")
+	var certPEM []byte
+	if plan.Sign {
+		var signResponse *SignResponse
+		if plan.Key == KeyReused && nebulaConfig.CertEndpoint != "" {
+			// The key is fine, try to get back the certificate the controller already issued for it
+			var caPEM string
+			signResponse, caPEM, err = recoverIssuedCert(ctx, client, nebulaConfig, md, accessToken, pubKeyBytes, time.Now())
+			if err == nil {
+				log.Printf("Recovered the issued certificate of %s from the controller\n", configPath)
+				tx.Put("ca.crt", []byte(caPEM))
+				plan.Recovered = true
+			} else {
+				log.Printf("Could not recover the issued certificate of %s, signing a new one: %s\n", configPath, err)
+			}
+		}
+		if signResponse == nil {
+			signResponse, err = signPublicKey(ctx, client, nebulaConfig, md, accessToken, pubKeyBytes)
+			if err != nil {
+				return false, err
+			}
+		}
+		certPEM = []byte(signResponse.Certificate)
+		tx.Put(certFileName, certPEM)
+
+		mnc := MinNodeConfig{
+			PKI: PKIConfig{
+				CA:        "ca.crt",
+				Cert:      certFileName,
+				Key:       keyFileName,
+				BlockList: signResponse.BlockList,
+			},
+			StaticHosts: signResponse.StaticHosts,
+			Lighthouse: LighthouseConfig{
+				AmLighthouse: false,
+				Hosts:        signResponse.LightHouses,
+			},
+		}
+		outBytes, err := yaml.Marshal(mnc)
+		if err != nil {
+			return false, err
+		}
+		tx.Put(controllerConfigFileName, outBytes)
+	} else {
+		certPEM, _ = ioutil.ReadFile(filepath.Join(configPath, certFileName))
+		if accessToken != "" && nebulaConfig.CertEndpoint != "" {
+			// Logged in for the node config anyway, so the CA bundle is refreshed from the cert endpoint too
+			caPEM, err := refreshCABundle(ctx, client, nebulaConfig, md, accessToken, pubKeyBytes, certPEM)
+			if err == nil {
+				tx.Put("ca.crt", []byte(caPEM))
+			} else {
+				log.Printf("Could not refresh the CA bundle of %s, using the one of the controller config: %s\n", configPath, err)
+			}
+		}
+	}
 
-	if _, err := os.Stat(defaultConfigPath); err == nil {
-		// path/to/whatever exists
-	} else if os.IsNotExist(err) {
-		//copy default config in
-		defaultConfigBytes, err := os.ReadFile("default.yml")
+	// The node config is not tied to the certificate, so changes made on the controller apply on the next activation
+	if nebulaConfig.NodeConfigEndpoint != "" {
+		nodeConfig, err := fetchNodeConfig(ctx, client, nebulaConfig.NodeConfigEndpoint, accessToken)
 		if err != nil {
-			return fmt.Errorf("Could not open default.yml!")
+			return false, err
 		}
+		tx.Put(nodeConfigFileName, nodeConfig)
+	}
 
-		out, err = os.Create(defaultConfigPath)
+	// New tunnels start from the default node config, existing ones are updated with -update-default
+	defaultConfigHash := ""
+	if _, err := os.Stat(filepath.Join(configPath, manager.DefaultConfigFileName)); os.IsNotExist(err) {
+		defaultConfigHash, err = manager.StageDefaultConfig(tx, md, false)
 		if err != nil {
-			return fmt.Errorf("Could not copy default.yml!")
+			return false, err
 		}
-		out.Write(defaultConfigBytes)
-		out.Close()
 	}
 
-	return nil
+	committed := tx.Len() > 0
+	// The metadata describes the key and default config, so a rollback has to restore it with them
+	err = manager.StageTunnelMetadata(tx, func(md *manager.ConfigMetadata) error {
+		recordKeyLifecycle(md, plan, certPEM)
+		if defaultConfigHash != "" {
+			md.DefaultConfig = defaultConfigHash
+		}
+		return nil
+	})
+	if err != nil {
+		return false, err
+	}
+
+	err = tx.Commit()
+	if err != nil {
+		return false, fmt.Errorf("Could not write tunnel artifacts: %w", err)
+	}
+	return committed, nil
 }
 
-func GetControllerInfo(urlStr string) (*NebulaConfig, error) {
+func GetControllerInfo(ctx context.Context, client *http.Client, urlStr string) (*NebulaConfig, error) {
 	u, err := url.Parse(urlStr)
+	if err != nil {
+		return nil, err
+	}
 	u.Path = path.Join(u.Path, "config")
 
-	client := &http.Client{}
-	req, err := http.NewRequest("GET", u.String(), nil)
+	req, err := http.NewRequestWithContext(ctx, "GET", u.String(), nil)
 	if err != nil {
-		fmt.Println(err)
 		return nil, err
 	}
 
 	nebulaConfigResp, err := client.Do(req)
 	if err != nil {
-		log.Println(err)
 		return nil, err
 	}
 	defer nebulaConfigResp.Body.Close()
 
+	if nebulaConfigResp.StatusCode != http.StatusOK {
+		return nil, responseError("controller config request", nebulaConfigResp)
+	}
+
 	var nebulaConfig NebulaConfig
 
 	err = json.NewDecoder(nebulaConfigResp.Body).Decode(&nebulaConfig)
 	if err != nil {
-		log.Println(err)
 		return nil, err
 	}
 
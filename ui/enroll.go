@@ -0,0 +1,97 @@
+package ui
+
+import (
+	"context"
+	"fmt"
+	"golang.org/x/sys/windows"
+	"golang.org/x/sys/windows/registry"
+	"log"
+	"nebula-windows-ui/manager"
+	"os"
+)
+
+const enrollHandlerKey = `Software\Classes\` + manager.EnrollScheme
+
+// RegisterEnrollURLHandler makes nebula:// links open this executable with -enroll for the current user.
+func RegisterEnrollURLHandler() error {
+	path, err := os.Executable()
+	if err != nil {
+		return err
+	}
+
+	key, _, err := registry.CreateKey(registry.CURRENT_USER, enrollHandlerKey, registry.SET_VALUE)
+	if err != nil {
+		return err
+	}
+	defer key.Close()
+	err = key.SetStringValue("", "URL:Nebula Enrollment")
+	if err != nil {
+		return err
+	}
+	err = key.SetStringValue("URL Protocol", "")
+	if err != nil {
+		return err
+	}
+
+	command, _, err := registry.CreateKey(registry.CURRENT_USER, enrollHandlerKey+`\shell\open\command`, registry.SET_VALUE)
+	if err != nil {
+		return err
+	}
+	defer command.Close()
+	return command.SetStringValue("", fmt.Sprintf(`"%s" -enroll "%%1"`, path))
+}
+
+// Enroll asks the user to confirm an enrollment link and creates the tunnel it describes.
+func Enroll(rawURL string) error {
+	link, err := manager.ParseEnrollLink(rawURL)
+	if err != nil {
+		return err
+	}
+
+	msg := fmt.Sprintf("Add the tunnel %s managed by %s?\n\nController key fingerprint:\n%s\n\nOnly continue if you were asked to by your administrator.",
+		link.TunnelName, link.ControllerURL, link.Fingerprint)
+	ctx := context.Background()
+	if link.Fingerprint == "" {
+		// Trust on first use: pin the key the controller presents now
+		client, err := newHTTPClient(nil, "")
+		if err != nil {
+			return err
+		}
+		link.Fingerprint, err = fetchControllerFingerprint(ctx, client, link.ControllerURL)
+		if err != nil {
+			return fmt.Errorf("could not reach %s: %s", link.ControllerURL, err)
+		}
+		msg = fmt.Sprintf("Add the tunnel %s managed by %s?\n\nThe link does not say which key the controller uses. It presents the key fingerprint:\n%s\n\nOnly continue if your administrator confirms this fingerprint.",
+			link.TunnelName, link.ControllerURL, link.Fingerprint)
+	}
+
+	// Pin the Nebula CA the controller hands out now, over the pinned connection
+	client, err := newHTTPClient(nil, link.Fingerprint)
+	if err != nil {
+		return err
+	}
+	nc, err := GetControllerInfo(ctx, client, link.ControllerURL)
+	if err != nil {
+		return fmt.Errorf("could not fetch the config of %s: %s", link.ControllerURL, err)
+	}
+	change, err := checkControllerCA(nil, nc.CACert)
+	if err != nil {
+		return err
+	}
+	msg += fmt.Sprintf("\n\nNebula CA:\n%s", change.describe(change.Pinned))
+
+	ret, _ := windows.MessageBox(0, windows.StringToUTF16Ptr(msg), windows.StringToUTF16Ptr("Nebula Enrollment"), windows.MB_YESNO|windows.MB_ICONQUESTION)
+	if ret != idYes {
+		return nil
+	}
+
+	tunnelName, err := manager.EnrollTunnel(manager.UserConfigRoot().Path, link, change.Pinned)
+	if err != nil {
+		return err
+	}
+	log.Printf("Enrolled tunnel %s with %s\n", tunnelName, link.ControllerURL)
+
+	msg = fmt.Sprintf("The tunnel %s was added. Activate it from the Nebula tray menu to sign in.", link.TunnelName)
+	windows.MessageBox(0, windows.StringToUTF16Ptr(msg), windows.StringToUTF16Ptr("Nebula Enrollment"), windows.MB_ICONINFORMATION)
+	return nil
+}
@@ -0,0 +1,166 @@
+package ui
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"nebula-windows-ui/manager"
+	"net"
+	"net/http"
+	"net/url"
+	"time"
+)
+
+const (
+	httpDialTimeout           = 10 * time.Second
+	httpTLSHandshakeTimeout   = 10 * time.Second
+	httpResponseHeaderTimeout = 30 * time.Second
+	httpDefaultTimeout        = 60 * time.Second
+	httpMaxAttempts           = 3
+	httpRetryBackoff          = time.Second
+)
+
+// newHTTPClient returns the client used to reach the controller and identity provider of a tunnel, configured by the
+// http section of its metadata. A non-empty fingerprint pins the TLS key of every server the client talks to.
+// Requests are bounded by timeouts, idempotent ones are retried, and all of them end when their context is canceled.
+func newHTTPClient(cfg *manager.HTTPConfig, fingerprint string) (*http.Client, error) {
+	if cfg == nil {
+		cfg = &manager.HTTPConfig{}
+	}
+
+	var roots *x509.CertPool
+	if len(cfg.RootCAs) > 0 {
+		var err error
+		roots, err = x509.SystemCertPool()
+		if err != nil {
+			return nil, fmt.Errorf("extra root CAs need the system roots: %s", err)
+		}
+		for i, ca := range cfg.RootCAs {
+			if !roots.AppendCertsFromPEM([]byte(ca)) {
+				return nil, fmt.Errorf("http.root_cas entry %d is not a PEM encoded certificate", i+1)
+			}
+		}
+	}
+
+	tlsConfig := &tls.Config{RootCAs: roots, MinVersion: tls.VersionTLS12}
+	if fingerprint != "" {
+		var err error
+		tlsConfig, err = pinnedTLSConfig(fingerprint, roots)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	proxy := systemProxy
+	switch cfg.Proxy {
+	case "":
+	case "direct":
+		proxy = nil
+	default:
+		u, err := url.Parse(cfg.Proxy)
+		if err != nil {
+			return nil, fmt.Errorf("invalid proxy: %s", err)
+		}
+		proxy = http.ProxyURL(u)
+	}
+
+	timeout := httpDefaultTimeout
+	if cfg.TimeoutSeconds > 0 {
+		timeout = time.Duration(cfg.TimeoutSeconds) * time.Second
+	}
+
+	transport := &http.Transport{
+		Proxy: proxy,
+		DialContext: (&net.Dialer{
+			Timeout:   httpDialTimeout,
+			KeepAlive: 30 * time.Second,
+		}).DialContext,
+		TLSClientConfig:       tlsConfig,
+		TLSHandshakeTimeout:   httpTLSHandshakeTimeout,
+		ResponseHeaderTimeout: httpResponseHeaderTimeout,
+		IdleConnTimeout:       90 * time.Second,
+		ForceAttemptHTTP2:     true,
+	}
+	return &http.Client{
+		Transport: &retryTransport{base: transport, attempts: httpMaxAttempts, backoff: httpRetryBackoff},
+		Timeout:   timeout,
+	}, nil
+}
+
+// retryTransport retries idempotent requests that failed on the network or were answered with a status asking to
+// come back later, doubling the backoff after every attempt.
+type retryTransport struct {
+	base     http.RoundTripper
+	attempts int
+	backoff  time.Duration
+}
+
+func (t *retryTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	if !idempotent(req) {
+		return t.base.RoundTrip(req)
+	}
+
+	delay := t.backoff
+	for attempt := 1; ; attempt++ {
+		resp, err := t.base.RoundTrip(req)
+		reason := retryReason(resp, err)
+		if reason == "" || attempt >= t.attempts || req.Context().Err() != nil {
+			return resp, err
+		}
+		if resp != nil {
+			io.Copy(io.Discard, io.LimitReader(resp.Body, 4096))
+			resp.Body.Close()
+		}
+
+		log.Printf("Retrying %s %s in %s: %s\n", req.Method, req.URL.Redacted(), delay, reason)
+		timer := time.NewTimer(delay)
+		select {
+		case <-req.Context().Done():
+			timer.Stop()
+			return nil, req.Context().Err()
+		case <-timer.C:
+		}
+		delay *= 2
+	}
+}
+
+func idempotent(req *http.Request) bool {
+	switch req.Method {
+	case "GET", "HEAD", "OPTIONS":
+		return req.Body == nil || req.Body == http.NoBody
+	}
+	return false
+}
+
+// retryReason returns why a request is worth retrying, or an empty string if it is not. Certificate problems do not
+// go away by asking again.
+func retryReason(resp *http.Response, err error) string {
+	if err != nil {
+		var pinErr *PinMismatchError
+		var unknownAuthority x509.UnknownAuthorityError
+		var invalid x509.CertificateInvalidError
+		var hostname x509.HostnameError
+		if errors.As(err, &pinErr) || errors.As(err, &unknownAuthority) || errors.As(err, &invalid) || errors.As(err, &hostname) {
+			return ""
+		}
+		return err.Error()
+	}
+	switch resp.StatusCode {
+	case http.StatusTooManyRequests, http.StatusBadGateway, http.StatusServiceUnavailable, http.StatusGatewayTimeout:
+		return resp.Status
+	}
+	return ""
+}
+
+// responseError turns an unexpected response into an error that carries the start of its body, which is usually
+// where servers explain what went wrong.
+func responseError(what string, resp *http.Response) error {
+	b, _ := io.ReadAll(io.LimitReader(resp.Body, 4096))
+	if len(b) == 0 {
+		return fmt.Errorf("%s failed with %s", what, resp.Status)
+	}
+	return fmt.Errorf("%s failed with %s: %s", what, resp.Status, b)
+}
@@ -0,0 +1,178 @@
+package ui
+
+import (
+	"bytes"
+	"fmt"
+	"github.com/slackhq/nebula/cert"
+	"golang.org/x/crypto/curve25519"
+	"io/ioutil"
+	"nebula-windows-ui/manager"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+const (
+	keyFileName              = "node.key"
+	pubKeyFileName           = "node.pub"
+	certFileName             = "node.crt"
+	controllerConfigFileName = "zz_controller_config.yml"
+)
+
+type KeyAction string
+
+const (
+	KeyReused    KeyAction = "reused"
+	KeyGenerated KeyAction = "generated"
+	KeyRotated   KeyAction = "rotated"
+)
+
+// keyPlan is what an activation does with the keypair and certificate of a controller managed tunnel.
+type keyPlan struct {
+	Key        KeyAction
+	Sign       bool
+	Reason     string
+	KeyCreated time.Time
+	// Recovered is set when the certificate was downloaded from the controller instead of signed
+	Recovered bool
+}
+
+func (p keyPlan) String() string {
+	if p.Sign {
+		return fmt.Sprintf("%s key, signing certificate (%s)", p.Key, p.Reason)
+	}
+	return fmt.Sprintf("%s key, reusing certificate (%s)", p.Key, p.Reason)
+}
+
+// loadKeyPair reads the keypair of a tunnel and makes sure both halves belong together.
+func loadKeyPair(configPath string) ([]byte, []byte, error) {
+	privPEM, err := ioutil.ReadFile(filepath.Join(configPath, keyFileName))
+	if err != nil {
+		return nil, nil, err
+	}
+	priv, _, err := cert.UnmarshalX25519PrivateKey(privPEM)
+	if err != nil || len(priv) != 32 {
+		return nil, nil, fmt.Errorf("invalid %s", keyFileName)
+	}
+	pubPEM, err := ioutil.ReadFile(filepath.Join(configPath, pubKeyFileName))
+	if err != nil {
+		return nil, nil, err
+	}
+	pub, _, err := cert.UnmarshalX25519PublicKey(pubPEM)
+	if err != nil {
+		return nil, nil, fmt.Errorf("invalid %s", pubKeyFileName)
+	}
+
+	derived, err := curve25519.X25519(priv, curve25519.Basepoint)
+	if err != nil || !bytes.Equal(derived, pub) {
+		return nil, nil, fmt.Errorf("%s does not match %s", pubKeyFileName, keyFileName)
+	}
+	return pub, priv, nil
+}
+
+// certNeedsSigning reports why the certificate of a tunnel can not be reused with the given public key, or an empty
+// string if it can.
+func certNeedsSigning(configPath string, pub []byte, caPEM string, renewBefore time.Duration, now time.Time) string {
+	if _, err := os.Stat(filepath.Join(configPath, controllerConfigFileName)); err != nil {
+		return "no controller config"
+	}
+	certPEM, err := ioutil.ReadFile(filepath.Join(configPath, certFileName))
+	if err != nil {
+		return "no certificate"
+	}
+	nc, _, err := cert.UnmarshalNebulaCertificateFromPEM(certPEM)
+	if err != nil {
+		return "invalid certificate"
+	}
+	if !bytes.Equal(nc.Details.PublicKey, pub) {
+		return "certificate is for another key"
+	}
+
+	// The controller lists more than one CA while it rotates them
+	pool, err := cert.NewCAPoolFromBytes([]byte(caPEM))
+	if err != nil {
+		return "certificate is not signed by the controller CA"
+	}
+	ca, err := pool.GetCAForCert(nc)
+	if err != nil || !nc.CheckSignature(ca.Details.PublicKey) {
+		return "certificate is not signed by the controller CA"
+	}
+
+	if certRenewalDue(nc, renewBefore, now) {
+		return fmt.Sprintf("certificate expires %s", nc.Details.NotAfter.Format(time.RFC3339))
+	}
+	return ""
+}
+
+// certRenewalDue reports whether a certificate expires within renewBefore, or within the last third of its lifetime
+// if renewBefore is zero.
+func certRenewalDue(nc *cert.NebulaCertificate, renewBefore time.Duration, now time.Time) bool {
+	if renewBefore == 0 {
+		renewBefore = nc.Details.NotAfter.Sub(nc.Details.NotBefore) / 3
+	}
+	return now.Add(renewBefore).After(nc.Details.NotAfter)
+}
+
+// planKeyLifecycle decides whether an activation keeps the keypair of a tunnel and whether it needs a new
+// certificate. Keys are kept while they are valid and younger than the rotation schedule, certificates while they are
+// valid for the key and not close to expiry.
+func planKeyLifecycle(configPath string, md *manager.ConfigMetadata, caPEM string, now time.Time) keyPlan {
+	var policy manager.KeyPolicyConfig
+	if md != nil && md.KeyPolicy != nil {
+		policy = *md.KeyPolicy
+	}
+
+	pub, _, err := loadKeyPair(configPath)
+	if err != nil {
+		return keyPlan{Key: KeyGenerated, Sign: true, Reason: fmt.Sprintf("no usable keypair: %s", err), KeyCreated: now}
+	}
+	if policy.RotateNow {
+		return keyPlan{Key: KeyRotated, Sign: true, Reason: "rotation requested", KeyCreated: now}
+	}
+
+	keyCreated := time.Time{}
+	if md != nil && md.KeyState != nil {
+		keyCreated = md.KeyState.KeyCreated
+	}
+	if keyCreated.IsZero() {
+		if fi, err := os.Stat(filepath.Join(configPath, keyFileName)); err == nil {
+			keyCreated = fi.ModTime()
+		}
+	}
+	if policy.RotateAfterDays > 0 && now.Sub(keyCreated) > time.Duration(policy.RotateAfterDays)*24*time.Hour {
+		return keyPlan{Key: KeyRotated, Sign: true, Reason: fmt.Sprintf("key is older than %d days", policy.RotateAfterDays), KeyCreated: now}
+	}
+
+	renewBefore := time.Duration(policy.RenewBeforeSeconds) * time.Second
+	if reason := certNeedsSigning(configPath, pub, caPEM, renewBefore, now); reason != "" {
+		return keyPlan{Key: KeyReused, Sign: true, Reason: reason, KeyCreated: keyCreated}
+	}
+	return keyPlan{Key: KeyReused, Reason: "certificate is valid", KeyCreated: keyCreated}
+}
+
+// recordKeyLifecycle stores the outcome of a plan in the tunnel metadata and clears a pending rotation request.
+// certPEM is the certificate the tunnel is left with.
+func recordKeyLifecycle(md *manager.ConfigMetadata, plan keyPlan, certPEM []byte) {
+	certExpires := time.Time{}
+	if nc, _, err := cert.UnmarshalNebulaCertificateFromPEM(certPEM); err == nil {
+		certExpires = nc.Details.NotAfter
+	}
+
+	certAction := "reused"
+	if plan.Recovered {
+		certAction = "recovered"
+	} else if plan.Sign {
+		certAction = "signed"
+	}
+	if md.KeyPolicy != nil {
+		md.KeyPolicy.RotateNow = false
+	}
+	md.KeyState = &manager.KeyLifecycleState{
+		KeyCreated:  plan.KeyCreated,
+		KeyAction:   string(plan.Key),
+		CertAction:  certAction,
+		Reason:      plan.Reason,
+		CertExpires: certExpires,
+		Updated:     time.Now(),
+	}
+}
@@ -0,0 +1,210 @@
+package ui
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"gopkg.in/yaml.v3"
+	"io"
+	"net"
+	"net/http"
+	"sort"
+	"strings"
+)
+
+// Nebula loads the files of a tunnel in name order and later files override earlier ones, so the controller node
+// config overrides default.yml, the user overrides override the controller and the controller pki config comes last.
+const (
+	nodeConfigFileName = "node_controller.yml"
+	overridesFileName  = "overrides.yml"
+	maxNodeConfigSize  = 1 << 20
+)
+
+const nodeConfigHeader = "# Managed by the controller and replaced whenever the tunnel is activated.\n" +
+	"# Put local changes in " + overridesFileName + ", which overrides this file.\n"
+
+// Sections of the node config the controller may set. pki and lighthouse hosts come from the sign response, local
+// services such as sshd are left to the user.
+var nodeConfigSections = map[string]bool{
+	"cipher":           true,
+	"firewall":         true,
+	"handshakes":       true,
+	"listen":           true,
+	"local_range":      true,
+	"logging":          true,
+	"preferred_ranges": true,
+	"punchy":           true,
+	"routines":         true,
+	"stats":            true,
+	"timers":           true,
+	"tun":              true,
+}
+
+// NodeConfigError lists every problem found in a node config returned by the controller.
+type NodeConfigError struct {
+	Problems []string
+}
+
+func (e *NodeConfigError) Error() string {
+	return fmt.Sprintf("controller sent an invalid node config: %s", strings.Join(e.Problems, "; "))
+}
+
+// fetchNodeConfig downloads the node config of the signed in user from the controller and returns it validated and
+// ready to be written to the tunnel directory.
+func fetchNodeConfig(ctx context.Context, client *http.Client, endpoint string, accessToken string) ([]byte, error) {
+	req, err := http.NewRequestWithContext(ctx, "GET", endpoint, nil)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Add("Authorization", fmt.Sprintf("Bearer %s", accessToken))
+	req.Header.Add("Accept", "application/yaml, application/json")
+
+	resp, err := client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	body, err := io.ReadAll(io.LimitReader(resp.Body, maxNodeConfigSize+1))
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("node config request failed with %s: %s", resp.Status, bytes.TrimSpace(body))
+	}
+	if len(body) > maxNodeConfigSize {
+		return nil, fmt.Errorf("node config is larger than %d bytes", maxNodeConfigSize)
+	}
+	return parseNodeConfig(body)
+}
+
+// parseNodeConfig validates a node config in YAML or JSON and returns it as YAML with the managed file header.
+func parseNodeConfig(body []byte) ([]byte, error) {
+	var nodeConfig map[string]interface{}
+	if err := yaml.Unmarshal(body, &nodeConfig); err != nil {
+		return nil, &NodeConfigError{Problems: []string{err.Error()}}
+	}
+	if problems := validateNodeConfig(nodeConfig); len(problems) > 0 {
+		return nil, &NodeConfigError{Problems: problems}
+	}
+
+	out, err := yaml.Marshal(nodeConfig)
+	if err != nil {
+		return nil, err
+	}
+	return append([]byte(nodeConfigHeader), out...), nil
+}
+
+func validateNodeConfig(nodeConfig map[string]interface{}) []string {
+	var problems []string
+	sections := make([]string, 0, len(nodeConfig))
+	for section := range nodeConfig {
+		sections = append(sections, section)
+	}
+	sort.Strings(sections)
+
+	for _, section := range sections {
+		value := nodeConfig[section]
+		if !nodeConfigSections[section] {
+			problems = append(problems, fmt.Sprintf("%s is not managed by the controller", section))
+			continue
+		}
+
+		switch section {
+		case "cipher", "local_range":
+			if _, ok := value.(string); !ok {
+				problems = append(problems, fmt.Sprintf("%s must be a string", section))
+			}
+		case "routines":
+			if _, ok := value.(int); !ok {
+				problems = append(problems, "routines must be a number")
+			}
+		case "preferred_ranges":
+			ranges, ok := value.([]interface{})
+			if !ok {
+				problems = append(problems, "preferred_ranges must be a list")
+				break
+			}
+			for _, r := range ranges {
+				if s, ok := r.(string); !ok || !isCIDR(s) {
+					problems = append(problems, fmt.Sprintf("preferred_ranges entry %v is not a CIDR", r))
+				}
+			}
+		default:
+			m, ok := value.(map[string]interface{})
+			if !ok {
+				problems = append(problems, fmt.Sprintf("%s must be a mapping", section))
+				break
+			}
+			switch section {
+			case "firewall":
+				problems = append(problems, validateFirewallRules(m)...)
+			case "tun":
+				problems = append(problems, validateUnsafeRoutes(m["unsafe_routes"])...)
+			}
+		}
+	}
+	return problems
+}
+
+func validateFirewallRules(firewall map[string]interface{}) []string {
+	var problems []string
+	for _, direction := range []string{"inbound", "outbound"} {
+		value, ok := firewall[direction]
+		if !ok {
+			continue
+		}
+		rules, ok := value.([]interface{})
+		if !ok {
+			problems = append(problems, fmt.Sprintf("firewall.%s must be a list", direction))
+			continue
+		}
+		for i, r := range rules {
+			rule, ok := r.(map[string]interface{})
+			if !ok {
+				problems = append(problems, fmt.Sprintf("firewall.%s rule %d must be a mapping", direction, i+1))
+				continue
+			}
+			if _, ok := rule["port"]; !ok {
+				if _, ok := rule["code"]; !ok {
+					problems = append(problems, fmt.Sprintf("firewall.%s rule %d has no port", direction, i+1))
+				}
+			}
+			if _, ok := rule["proto"]; !ok {
+				problems = append(problems, fmt.Sprintf("firewall.%s rule %d has no proto", direction, i+1))
+			}
+		}
+	}
+	return problems
+}
+
+func validateUnsafeRoutes(value interface{}) []string {
+	if value == nil {
+		return nil
+	}
+	routes, ok := value.([]interface{})
+	if !ok {
+		return []string{"tun.unsafe_routes must be a list"}
+	}
+
+	var problems []string
+	for i, r := range routes {
+		route, ok := r.(map[string]interface{})
+		if !ok {
+			problems = append(problems, fmt.Sprintf("tun.unsafe_routes entry %d must be a mapping", i+1))
+			continue
+		}
+		if s, ok := route["route"].(string); !ok || !isCIDR(s) {
+			problems = append(problems, fmt.Sprintf("tun.unsafe_routes entry %d has no valid route", i+1))
+		}
+		if s, ok := route["via"].(string); !ok || net.ParseIP(s) == nil {
+			problems = append(problems, fmt.Sprintf("tun.unsafe_routes entry %d has no valid via", i+1))
+		}
+	}
+	return problems
+}
+
+func isCIDR(s string) bool {
+	_, _, err := net.ParseCIDR(s)
+	return err == nil
+}
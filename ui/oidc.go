@@ -36,36 +36,36 @@ type OpenIDTokens struct {
 	TokenType        string `json:"token_type,omitempty"`
 }
 
-func getOIDCConfig(oidcConfigURL string) (*OpenIDConfiguration, error) {
-	client := &http.Client{}
-	req, err := http.NewRequest("GET", oidcConfigURL, nil)
+func getOIDCConfig(ctx context.Context, client *http.Client, oidcConfigURL string) (*OpenIDConfiguration, error) {
+	req, err := http.NewRequestWithContext(ctx, "GET", oidcConfigURL, nil)
 	if err != nil {
-		fmt.Println(err)
 		return nil, err
 	}
 
 	oidcConfigResp, err := client.Do(req)
 	if err != nil {
-		fmt.Println(err)
 		return nil, err
 	}
 	defer oidcConfigResp.Body.Close()
 
+	if oidcConfigResp.StatusCode != http.StatusOK {
+		return nil, responseError("OIDC config request", oidcConfigResp)
+	}
+
 	var oidcConfig OpenIDConfiguration
 
 	err = json.NewDecoder(oidcConfigResp.Body).Decode(&oidcConfig)
 	if err != nil {
-		fmt.Println(err)
 		return nil, err
 	}
 	return &oidcConfig, nil
 }
 
-func DoOIDCLogin(oidcConfigURL string, oidcClientID string) (string, error) {
-	oidcConfig, err := getOIDCConfig(oidcConfigURL)
+func DoOIDCLogin(ctx context.Context, client *http.Client, oidcConfigURL string, oidcClientID string) (string, error) {
+	oidcConfig, err := getOIDCConfig(ctx, client, oidcConfigURL)
 
 	if err != nil {
-		return "", errors.New("Could not retrieve OIDC config")
+		return "", fmt.Errorf("Could not retrieve OIDC config: %w", err)
 	}
 
 	b := make([]byte, 3*16)
@@ -94,8 +94,11 @@ func DoOIDCLogin(oidcConfigURL string, oidcClientID string) (string, error) {
 	cmd = exec.Command("rundll32", "url.dll,FileProtocolHandler", authUrl)
 	cmd.Start()
 
-	otp, _ := waitForOTP(90, 4242)
+	otp, _ := waitForOTP(ctx, 90, 4242)
 
+	if err := ctx.Err(); err != nil {
+		return "", err
+	}
 	if otp == "" {
 		return "", errors.New("timed out waiting for auth login")
 	}
@@ -107,25 +110,20 @@ func DoOIDCLogin(oidcConfigURL string, oidcClientID string) (string, error) {
 	params.Add("redirect_uri", "http://localhost:4242/")
 	params.Add("code_verifier", v)
 
-	client := &http.Client{}
-	req, err := http.NewRequest("POST", oidcConfig.TokenEndpoint, strings.NewReader(params.Encode()))
-	req.Header.Add("Content-Type", "application/x-www-form-urlencoded")
-
+	req, err := http.NewRequestWithContext(ctx, "POST", oidcConfig.TokenEndpoint, strings.NewReader(params.Encode()))
 	if err != nil {
-		log.Println(err)
 		return "", err
 	}
+	req.Header.Add("Content-Type", "application/x-www-form-urlencoded")
 
 	tokenResp, err := client.Do(req)
 	if err != nil {
-		log.Println(err)
 		return "", err
 	}
 	defer tokenResp.Body.Close()
 
-	if tokenResp.StatusCode != 200 {
-		b, _ := io.ReadAll(tokenResp.Body)
-		log.Fatalf("%s", b)
+	if tokenResp.StatusCode != http.StatusOK {
+		return "", responseError("OIDC token request", tokenResp)
 	}
 
 	var tokens OpenIDTokens
@@ -138,13 +136,13 @@ func DoOIDCLogin(oidcConfigURL string, oidcClientID string) (string, error) {
 	return tokens.AccessToken, nil
 }
 
-func waitForOTP(timeout int, callbackPort int) (string, string) {
+func waitForOTP(parent context.Context, timeout int, callbackPort int) (string, string) {
 
 	var srv http.Server
 	var otp string
 	var state string
 
-	ctx, cancel := context.WithTimeout(context.Background(), time.Second*time.Duration(timeout))
+	ctx, cancel := context.WithTimeout(parent, time.Second*time.Duration(timeout))
 	defer cancel()
 
 	srv = http.Server{
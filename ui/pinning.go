@@ -0,0 +1,148 @@
+package ui
+
+import (
+	"context"
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"golang.org/x/sys/windows"
+	"log"
+	"nebula-windows-ui/manager"
+	"net/http"
+	"net/url"
+	"path"
+)
+
+// PinMismatchError is returned when a controller presents a TLS key other than the one its tunnel is pinned to.
+type PinMismatchError struct {
+	Host      string
+	Pinned    string
+	Presented string
+}
+
+func (e *PinMismatchError) Error() string {
+	host := e.Host
+	if host == "" {
+		// Servers reached by IP address send no server name
+		host = "the controller"
+	}
+	return fmt.Sprintf("%s presented the TLS key %s, but the tunnel is pinned to %s", host, e.Presented, e.Pinned)
+}
+
+// SPKIFingerprint returns the hex encoded SHA-256 of the subject public key info of a certificate, which stays the
+// same when a certificate is renewed with the same key.
+func SPKIFingerprint(c *x509.Certificate) string {
+	sum := sha256.Sum256(c.RawSubjectPublicKeyInfo)
+	return hex.EncodeToString(sum[:])
+}
+
+// pinnedTLSConfig verifies the server chain against roots as usual and in addition requires the key of one of the
+// certificates in a verified chain to match fingerprint. Certificates the server only sends along are not trusted,
+// anyone can send the public certificate of the controller. A nil roots uses the system roots.
+func pinnedTLSConfig(fingerprint string, roots *x509.CertPool) (*tls.Config, error) {
+	pin, err := manager.NormalizeFingerprint(fingerprint)
+	if err != nil {
+		return nil, err
+	}
+	return &tls.Config{
+		RootCAs:    roots,
+		MinVersion: tls.VersionTLS12,
+		VerifyConnection: func(cs tls.ConnectionState) error {
+			if len(cs.PeerCertificates) == 0 {
+				return errors.New("controller presented no certificate")
+			}
+			for _, chain := range cs.VerifiedChains {
+				for _, c := range chain {
+					if SPKIFingerprint(c) == pin {
+						return nil
+					}
+				}
+			}
+			return &PinMismatchError{Host: cs.ServerName, Pinned: pin, Presented: SPKIFingerprint(cs.PeerCertificates[0])}
+		},
+	}, nil
+}
+
+// fetchControllerFingerprint asks a controller for its config and returns the fingerprint of the key it presents.
+// The client must not be pinned.
+func fetchControllerFingerprint(ctx context.Context, client *http.Client, controllerURL string) (string, error) {
+	u, err := url.Parse(controllerURL)
+	if err != nil {
+		return "", err
+	}
+	if u.Scheme != "https" {
+		return "", fmt.Errorf("%s is not an https URL", controllerURL)
+	}
+	u.Path = path.Join(u.Path, "config")
+
+	req, err := http.NewRequestWithContext(ctx, "GET", u.String(), nil)
+	if err != nil {
+		return "", err
+	}
+	resp, err := client.Do(req)
+	if err != nil {
+		return "", err
+	}
+	resp.Body.Close()
+	if resp.TLS == nil || len(resp.TLS.PeerCertificates) == 0 {
+		return "", errors.New("controller presented no certificate")
+	}
+	return SPKIFingerprint(resp.TLS.PeerCertificates[0]), nil
+}
+
+// controllerClient returns the http client used to talk to the controller of a tunnel. Tunnels without a pinned
+// fingerprint, such as ones created before pinning, offer to trust the key the controller presents now and record it.
+// Plain http is refused unless the metadata opts into it and the user confirms.
+func controllerClient(ctx context.Context, t manager.Tunnel, md *manager.ConfigMetadata) (*http.Client, error) {
+	u, err := url.Parse(md.ControllerURL)
+	if err != nil {
+		return nil, err
+	}
+	if u.Scheme != "https" {
+		if md.Fingerprint != "" {
+			return nil, fmt.Errorf("the controller of %s is pinned but not reached over https", t.Title())
+		}
+		if !md.InsecureHTTP {
+			return nil, fmt.Errorf("the controller of %s is not reached over https, set insecure_http in its metadata to allow it", t.Title())
+		}
+		msg := fmt.Sprintf("The controller of %s is reached over plain http at %s.\n\nIts identity can not be verified and anyone on the network can read and change the login and certificate. Only continue on a test network.",
+			t.Title(), md.ControllerURL)
+		ret, _ := windows.MessageBox(0, windows.StringToUTF16Ptr(msg), windows.StringToUTF16Ptr("Nebula"), windows.MB_YESNO|windows.MB_ICONWARNING|windows.MB_DEFBUTTON2)
+		if ret != idYes {
+			return nil, fmt.Errorf("the controller of %s is not trusted", t.Title())
+		}
+		log.Printf("Controller of %s is reached over http, its identity can not be verified\n", &t)
+		return newHTTPClient(md.HTTP, "")
+	}
+
+	if md.Fingerprint == "" {
+		client, err := newHTTPClient(md.HTTP, "")
+		if err != nil {
+			return nil, err
+		}
+		fingerprint, err := fetchControllerFingerprint(ctx, client, md.ControllerURL)
+		if err != nil {
+			return nil, err
+		}
+		msg := fmt.Sprintf("The controller of %s has not been verified before.\n\n%s presents the key fingerprint:\n%s\n\nOnly trust it if your administrator confirms this fingerprint.",
+			t.Title(), md.ControllerURL, fingerprint)
+		ret, _ := windows.MessageBox(0, windows.StringToUTF16Ptr(msg), windows.StringToUTF16Ptr("Nebula"), windows.MB_YESNO|windows.MB_ICONWARNING)
+		if ret != idYes {
+			return nil, fmt.Errorf("the controller of %s is not trusted", t.Title())
+		}
+
+		err = manager.UpdateTunnelMetadata(t.Path, func(md *manager.ConfigMetadata) error {
+			md.Fingerprint = fingerprint
+			return nil
+		})
+		if err != nil {
+			return nil, fmt.Errorf("could not record the controller fingerprint: %s", err)
+		}
+		log.Printf("Pinned the controller of %s to %s\n", &t, fingerprint)
+		md.Fingerprint = fingerprint
+	}
+	return newHTTPClient(md.HTTP, md.Fingerprint)
+}
@@ -0,0 +1,150 @@
+package ui
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"errors"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// countingTransport counts the round trips that reach the network.
+type countingTransport struct {
+	base  http.RoundTripper
+	count int32
+}
+
+func (t *countingTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	atomic.AddInt32(&t.count, 1)
+	return t.base.RoundTrip(req)
+}
+
+func newPinnedTestClient(t *testing.T, srv *httptest.Server, fingerprint string) (*http.Client, *countingTransport) {
+	roots := x509.NewCertPool()
+	roots.AddCert(srv.Certificate())
+	tlsConfig, err := pinnedTLSConfig(fingerprint, roots)
+	if err != nil {
+		t.Fatal(err)
+	}
+	counting := &countingTransport{base: &http.Transport{TLSClientConfig: tlsConfig}}
+	client := &http.Client{
+		Transport: &retryTransport{base: counting, attempts: httpMaxAttempts, backoff: time.Millisecond},
+		Timeout:   10 * time.Second,
+	}
+	return client, counting
+}
+
+func newControllerTestServer() *httptest.Server {
+	return httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("{}"))
+	}))
+}
+
+func TestPinnedClientAcceptsPinnedKey(t *testing.T) {
+	srv := newControllerTestServer()
+	defer srv.Close()
+
+	client, _ := newPinnedTestClient(t, srv, SPKIFingerprint(srv.Certificate()))
+	resp, err := client.Get(srv.URL + "/config")
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("unexpected status %s", resp.Status)
+	}
+}
+
+func TestPinnedClientRejectsOtherKey(t *testing.T) {
+	srv := newControllerTestServer()
+	defer srv.Close()
+
+	// The server is trusted by the roots but presents a key other than the pinned one.
+	pinned := strings.Repeat("ab", 32)
+	client, counting := newPinnedTestClient(t, srv, pinned)
+	_, err := client.Get(srv.URL + "/config")
+
+	var pinErr *PinMismatchError
+	if !errors.As(err, &pinErr) {
+		t.Fatalf("expected a PinMismatchError, got %v", err)
+	}
+	if pinErr.Pinned != pinned || pinErr.Presented != SPKIFingerprint(srv.Certificate()) {
+		t.Fatalf("unexpected fingerprints in %v", pinErr)
+	}
+	if n := atomic.LoadInt32(&counting.count); n != 1 {
+		t.Fatalf("a pin mismatch was retried, %d attempts", n)
+	}
+}
+
+// newSelfSignedCert returns a certificate standing in for the real controller, whose public certificate anyone can
+// present.
+func newSelfSignedCert(t *testing.T) *x509.Certificate {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject:      pkix.Name{CommonName: "controller.example.com"},
+		DNSNames:     []string{"controller.example.com"},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	c, err := x509.ParseCertificate(der)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return c
+}
+
+func TestPinnedClientRejectsAppendedPinnedCert(t *testing.T) {
+	controller := newSelfSignedCert(t)
+	srv := newControllerTestServer()
+	defer srv.Close()
+
+	// The server presents its own trusted certificate and sends the pinned controller certificate along with it,
+	// which is not part of the verified chain.
+	cert := &srv.TLS.Certificates[0]
+	cert.Certificate = append(cert.Certificate, controller.Raw)
+
+	client, _ := newPinnedTestClient(t, srv, SPKIFingerprint(controller))
+	_, err := client.Get(srv.URL + "/config")
+
+	var pinErr *PinMismatchError
+	if !errors.As(err, &pinErr) {
+		t.Fatalf("expected a PinMismatchError, got %v", err)
+	}
+	if pinErr.Presented != SPKIFingerprint(srv.Certificate()) {
+		t.Fatalf("unexpected presented fingerprint in %v", pinErr)
+	}
+}
+
+func TestFetchControllerFingerprint(t *testing.T) {
+	srv := newControllerTestServer()
+	defer srv.Close()
+
+	fingerprint, err := fetchControllerFingerprint(context.Background(), srv.Client(), srv.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if fingerprint != SPKIFingerprint(srv.Certificate()) {
+		t.Fatalf("got fingerprint %s, the server presents %s", fingerprint, SPKIFingerprint(srv.Certificate()))
+	}
+
+	if _, err := fetchControllerFingerprint(context.Background(), srv.Client(), "http://"+srv.Listener.Addr().String()); err == nil {
+		t.Fatal("fetched a fingerprint over plain http")
+	}
+}
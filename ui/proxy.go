@@ -0,0 +1,91 @@
+package ui
+
+import (
+	"golang.org/x/sys/windows/registry"
+	"net"
+	"net/http"
+	"net/url"
+	"path"
+	"strings"
+)
+
+const internetSettingsKey = `Software\Microsoft\Windows\CurrentVersion\Internet Settings`
+
+// systemProxy returns the proxy from the Windows internet settings of the user for a request, or the one from the
+// environment if no proxy is set there. Automatic configuration scripts are not supported.
+func systemProxy(req *http.Request) (*url.URL, error) {
+	key, err := registry.OpenKey(registry.CURRENT_USER, internetSettingsKey, registry.QUERY_VALUE)
+	if err != nil {
+		return http.ProxyFromEnvironment(req)
+	}
+	defer key.Close()
+
+	enabled, _, err := key.GetIntegerValue("ProxyEnable")
+	if err != nil || enabled == 0 {
+		return http.ProxyFromEnvironment(req)
+	}
+	server, _, err := key.GetStringValue("ProxyServer")
+	if err != nil || server == "" {
+		return http.ProxyFromEnvironment(req)
+	}
+	override, _, _ := key.GetStringValue("ProxyOverride")
+	if bypassProxy(req.URL.Hostname(), override) {
+		return nil, nil
+	}
+	return parseProxyServer(server, req.URL.Scheme)
+}
+
+// parseProxyServer picks the proxy for scheme out of a ProxyServer value, which is either host:port for every scheme
+// or a list like http=host:port;https=host:port;socks=host:port.
+func parseProxyServer(server string, scheme string) (*url.URL, error) {
+	var socks string
+	for _, entry := range strings.Split(server, ";") {
+		entry = strings.TrimSpace(entry)
+		if entry == "" {
+			continue
+		}
+		i := strings.Index(entry, "=")
+		if i < 0 {
+			return proxyURL("http", entry)
+		}
+		switch strings.ToLower(entry[:i]) {
+		case scheme:
+			return proxyURL("http", entry[i+1:])
+		case "socks":
+			socks = entry[i+1:]
+		}
+	}
+	if socks != "" {
+		return proxyURL("socks5", socks)
+	}
+	return nil, nil
+}
+
+func proxyURL(scheme string, hostPort string) (*url.URL, error) {
+	if strings.Contains(hostPort, "://") {
+		return url.Parse(hostPort)
+	}
+	return url.Parse(scheme + "://" + hostPort)
+}
+
+// bypassProxy reports whether host matches the ProxyOverride list, whose entries are wildcard patterns or <local>
+// for host names without a dot.
+func bypassProxy(host string, override string) bool {
+	host = strings.ToLower(host)
+	for _, pattern := range strings.Split(override, ";") {
+		pattern = strings.ToLower(strings.TrimSpace(pattern))
+		if pattern == "" {
+			continue
+		}
+		if pattern == "<local>" {
+			if !strings.Contains(host, ".") && net.ParseIP(host) == nil {
+				return true
+			}
+			continue
+		}
+		if matched, _ := path.Match(pattern, host); matched {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,86 @@
+package ui
+
+import (
+	"log"
+	"nebula-windows-ui/manager"
+	"net"
+	"sort"
+)
+
+// SignDefaults are the sign request parameters a controller advertises in its /config response.
+type SignDefaults struct {
+	IP          string   `json:"ip,omitempty"`
+	Duration    int      `json:"duration,omitempty"`
+	MaxDuration int      `json:"maxDuration,omitempty"`
+	Groups      []string `json:"groups,omitempty"`
+	Subnets     []string `json:"subnets,omitempty"`
+}
+
+// buildSignRequest combines the controller defaults with the per-tunnel overrides from metadata. Fields left empty
+// are decided by the controller.
+func buildSignRequest(nc *NebulaConfig, md *manager.ConfigMetadata, publicKey []byte) SignRequest {
+	signReq := SignRequest{PublicKey: string(publicKey)}
+	if nc.SignDefaults != nil {
+		signReq.IP = nc.SignDefaults.IP
+		signReq.Duration = nc.SignDefaults.Duration
+		signReq.Groups = nc.SignDefaults.Groups
+		signReq.Subnets = nc.SignDefaults.Subnets
+	}
+
+	if md != nil && md.SignRequest != nil {
+		if md.SignRequest.IP != "" {
+			signReq.IP = md.SignRequest.IP
+		}
+		if md.SignRequest.DurationSeconds != 0 {
+			signReq.Duration = md.SignRequest.DurationSeconds
+		}
+		if len(md.SignRequest.Groups) > 0 {
+			signReq.Groups = md.SignRequest.Groups
+		}
+		if len(md.SignRequest.Subnets) > 0 {
+			signReq.Subnets = md.SignRequest.Subnets
+		}
+	}
+
+	if nc.SignDefaults != nil && nc.SignDefaults.MaxDuration > 0 && signReq.Duration > nc.SignDefaults.MaxDuration {
+		log.Printf("Requested certificate duration %ds exceeds the controller maximum, asking for %ds\n", signReq.Duration, nc.SignDefaults.MaxDuration)
+		signReq.Duration = nc.SignDefaults.MaxDuration
+	}
+	return signReq
+}
+
+func sameStrings(a []string, b []string) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	a = append([]string(nil), a...)
+	b = append([]string(nil), b...)
+	sort.Strings(a)
+	sort.Strings(b)
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+	return true
+}
+
+func ipNetStrings(networks []*net.IPNet) []string {
+	s := make([]string, 0, len(networks))
+	for _, n := range networks {
+		s = append(s, n.String())
+	}
+	return s
+}
+
+func normalizeCIDRs(cidrs []string) ([]string, error) {
+	normalized := make([]string, 0, len(cidrs))
+	for _, c := range cidrs {
+		ip, network, err := net.ParseCIDR(c)
+		if err != nil {
+			return nil, err
+		}
+		normalized = append(normalized, (&net.IPNet{IP: ip, Mask: network.Mask}).String())
+	}
+	return normalized, nil
+}
@@ -0,0 +1,227 @@
+package ui
+
+import (
+	"fmt"
+	"nebula-windows-ui/manager"
+	"sort"
+	"sync"
+)
+
+// menuItem is the subset of *systray.MenuItem the tray model drives, so the model can be exercised without a real
+// system tray.
+type menuItem interface {
+	SetTitle(title string)
+	SetTooltip(tooltip string)
+	Check()
+	Uncheck()
+	Enable()
+	Disable()
+	Hide()
+	Show()
+}
+
+// tunnelSlot is a reserved pair of tray entries for one tunnel: the toggle item in the main menu and its entry in
+// the log submenu. systray loses submenus when an item is hidden and shown again, so both are leaf items.
+type tunnelSlot struct {
+	item    menuItem
+	showLog menuItem
+
+	tunnel string
+}
+
+type trayTunnel struct {
+	tunnel manager.Tunnel
+	state  manager.TunnelState
+	err    error
+	slot   *tunnelSlot
+}
+
+type tunnelPresentation struct {
+	title   string
+	tooltip string
+	checked bool
+	enabled bool
+}
+
+func presentTunnel(name string, state manager.TunnelState, err error) tunnelPresentation {
+	p := tunnelPresentation{title: name, enabled: true}
+
+	switch state {
+	case manager.TunnelStarted:
+		p.tooltip = "Active, click to deactivate"
+		p.checked = true
+	case manager.TunnelDegraded:
+		reason := "no lighthouse is reachable"
+		if err != nil {
+			reason = err.Error()
+		}
+		p.title = fmt.Sprintf("%s (Degraded)", name)
+		p.tooltip = fmt.Sprintf("Connected, but %s", reason)
+		p.checked = true
+	case manager.TunnelStarting:
+		p.title = fmt.Sprintf("%s (Connecting…)", name)
+		p.tooltip = "Connecting, click to cancel"
+	case manager.TunnelStopping:
+		p.title = fmt.Sprintf("%s (Disconnecting…)", name)
+		p.tooltip = "Disconnecting"
+		p.enabled = false
+	default:
+		p.tooltip = "Inactive, click to activate"
+		if err != nil {
+			p.tooltip = fmt.Sprintf("Inactive: %s", err)
+		}
+	}
+	return p
+}
+
+func setEnabled(item menuItem, enabled bool) {
+	if enabled {
+		item.Enable()
+	} else {
+		item.Disable()
+	}
+}
+
+// trayModel maps the manager's view of the tunnels onto a fixed pool of tray menu slots, in order of their titles.
+// Slots are shown and hidden as tunnels appear and disappear, and their checkmarks and enabled state always follow
+// the last state reported for the tunnel. Tunnels that do not fit get overflow slots from newSlot, which are dropped
+// again once hideOverflow reports that it hid them.
+type trayModel struct {
+	lock         sync.Mutex
+	slots        []*tunnelSlot
+	reserved     int
+	tunnels      map[string]*trayTunnel
+	newSlot      func() *tunnelSlot
+	hideOverflow func() bool
+}
+
+func newTrayModel(slots []*tunnelSlot, newSlot func() *tunnelSlot, hideOverflow func() bool) *trayModel {
+	for _, s := range slots {
+		s.item.Hide()
+		s.showLog.Hide()
+	}
+	return &trayModel{
+		slots:        slots,
+		reserved:     len(slots),
+		tunnels:      make(map[string]*trayTunnel),
+		newSlot:      newSlot,
+		hideOverflow: hideOverflow,
+	}
+}
+
+// slot returns the i-th slot, adding overflow slots as needed, or nil if there is none.
+func (m *trayModel) slot(i int) *tunnelSlot {
+	for len(m.slots) <= i {
+		if m.newSlot == nil {
+			return nil
+		}
+		s := m.newSlot()
+		if s == nil {
+			return nil
+		}
+		m.slots = append(m.slots, s)
+	}
+	return m.slots[i]
+}
+
+func (m *trayModel) render(t *trayTunnel) {
+	if t.slot == nil {
+		return
+	}
+	p := presentTunnel(t.tunnel.Title(), t.state, t.err)
+	t.slot.item.SetTitle(p.title)
+	t.slot.item.SetTooltip(p.tooltip)
+	if p.checked {
+		t.slot.item.Check()
+	} else {
+		t.slot.item.Uncheck()
+	}
+	setEnabled(t.slot.item, p.enabled)
+	t.slot.showLog.SetTitle(t.tunnel.Title())
+}
+
+// SetTunnels replaces the list of known tunnels and reassigns the slots in order of their titles. Slots that are no
+// longer needed are hidden, and the overflow slots once none of them is in use.
+func (m *trayModel) SetTunnels(tunnels []manager.Tunnel) {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+
+	sorted := append([]manager.Tunnel(nil), tunnels...)
+	sort.Slice(sorted, func(i, j int) bool {
+		if sorted[i].Title() != sorted[j].Title() {
+			return sorted[i].Title() < sorted[j].Title()
+		}
+		return sorted[i].Name < sorted[j].Name
+	})
+
+	known := make(map[string]*trayTunnel, len(sorted))
+	for i, t := range sorted {
+		tt, ok := m.tunnels[t.Name]
+		if !ok {
+			tt = &trayTunnel{state: t.State}
+		}
+		tt.tunnel = t
+		tt.slot = m.slot(i)
+		if tt.slot != nil {
+			if tt.slot.tunnel == "" {
+				tt.slot.item.Show()
+				tt.slot.showLog.Show()
+			}
+			tt.slot.tunnel = t.Name
+		}
+		known[t.Name] = tt
+		m.render(tt)
+	}
+	m.tunnels = known
+
+	for i := len(sorted); i < len(m.slots); i++ {
+		if s := m.slots[i]; s.tunnel != "" {
+			s.tunnel = ""
+			s.item.Hide()
+			s.showLog.Hide()
+		}
+	}
+	if len(sorted) <= m.reserved && len(m.slots) > m.reserved && m.hideOverflow != nil && m.hideOverflow() {
+		m.slots = m.slots[:m.reserved]
+	}
+}
+
+// SetState records the authoritative state of a tunnel and updates its menu entry.
+func (m *trayModel) SetState(name string, state manager.TunnelState, err error) {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+
+	t, ok := m.tunnels[name]
+	if !ok {
+		return
+	}
+	t.state = state
+	t.err = err
+	m.render(t)
+}
+
+func (m *trayModel) State(name string) manager.TunnelState {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+
+	t, ok := m.tunnels[name]
+	if !ok {
+		return manager.TunnelUnknown
+	}
+	return t.state
+}
+
+// TunnelForSlot returns the tunnel currently shown in a slot.
+func (m *trayModel) TunnelForSlot(slot *tunnelSlot) (manager.Tunnel, bool) {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+
+	if slot.tunnel == "" {
+		return manager.Tunnel{}, false
+	}
+	t, ok := m.tunnels[slot.tunnel]
+	if !ok {
+		return manager.Tunnel{}, false
+	}
+	return t.tunnel, true
+}
@@ -0,0 +1,226 @@
+package ui
+
+import (
+	"errors"
+	"nebula-windows-ui/manager"
+	"strings"
+	"testing"
+)
+
+type fakeMenuItem struct {
+	title    string
+	tooltip  string
+	checked  bool
+	disabled bool
+	hidden   bool
+}
+
+func (i *fakeMenuItem) SetTitle(title string)     { i.title = title }
+func (i *fakeMenuItem) SetTooltip(tooltip string) { i.tooltip = tooltip }
+func (i *fakeMenuItem) Check()                    { i.checked = true }
+func (i *fakeMenuItem) Uncheck()                  { i.checked = false }
+func (i *fakeMenuItem) Enable()                   { i.disabled = false }
+func (i *fakeMenuItem) Disable()                  { i.disabled = true }
+func (i *fakeMenuItem) Hide()                     { i.hidden = true }
+func (i *fakeMenuItem) Show()                     { i.hidden = false }
+
+func newFakeSlot() *tunnelSlot {
+	return &tunnelSlot{item: &fakeMenuItem{}, showLog: &fakeMenuItem{}}
+}
+
+func newFakeSlots(n int) []*tunnelSlot {
+	slots := make([]*tunnelSlot, n)
+	for i := range slots {
+		slots[i] = newFakeSlot()
+	}
+	return slots
+}
+
+func slotItem(s *tunnelSlot) *fakeMenuItem {
+	return s.item.(*fakeMenuItem)
+}
+
+func slotLog(s *tunnelSlot) *fakeMenuItem {
+	return s.showLog.(*fakeMenuItem)
+}
+
+func TestTrayModelAssignsSlots(t *testing.T) {
+	slots := newFakeSlots(3)
+	m := newTrayModel(slots, nil, nil)
+	for i, s := range slots {
+		if !slotItem(s).hidden || !slotLog(s).hidden {
+			t.Fatalf("slot %d is not hidden before tunnels are known", i)
+		}
+	}
+
+	m.SetTunnels([]manager.Tunnel{
+		{Name: "b", State: manager.TunnelStopped},
+		{Name: "c", DisplayName: "Office", State: manager.TunnelStarted},
+	})
+
+	// Tunnels are placed in order of their titles, not their names
+	if tunnel, ok := m.TunnelForSlot(slots[0]); !ok || tunnel.Name != "c" {
+		t.Fatalf("expected c in the first slot, got %v", tunnel)
+	}
+	if tunnel, ok := m.TunnelForSlot(slots[1]); !ok || tunnel.Name != "b" {
+		t.Fatalf("expected b in the second slot, got %v", tunnel)
+	}
+	if _, ok := m.TunnelForSlot(slots[2]); ok || !slotItem(slots[2]).hidden {
+		t.Fatal("the unused slot is in use")
+	}
+
+	office := slotItem(slots[0])
+	if office.hidden || office.title != "Office" || !office.checked || office.disabled {
+		t.Fatalf("unexpected entry for a started tunnel: %+v", office)
+	}
+	if slotLog(slots[0]).hidden || slotLog(slots[0]).title != "Office" {
+		t.Fatalf("unexpected log entry: %+v", slotLog(slots[0]))
+	}
+	if b := slotItem(slots[1]); b.hidden || b.title != "b" || b.checked {
+		t.Fatalf("unexpected entry for a stopped tunnel: %+v", b)
+	}
+}
+
+func TestTrayModelHidesAndReusesSlots(t *testing.T) {
+	slots := newFakeSlots(2)
+	m := newTrayModel(slots, nil, nil)
+	m.SetTunnels([]manager.Tunnel{{Name: "a"}, {Name: "b"}})
+
+	m.SetTunnels([]manager.Tunnel{{Name: "b"}})
+	if tunnel, ok := m.TunnelForSlot(slots[0]); !ok || tunnel.Name != "b" || slotItem(slots[0]).title != "b" {
+		t.Fatalf("expected b to move up to the first slot, got %v", tunnel)
+	}
+	if !slotItem(slots[1]).hidden || !slotLog(slots[1]).hidden {
+		t.Fatal("the slot no longer needed is still shown")
+	}
+	if _, ok := m.TunnelForSlot(slots[1]); ok {
+		t.Fatal("the slot no longer needed still maps to a tunnel")
+	}
+	if m.State("a") != manager.TunnelUnknown {
+		t.Fatal("a removed tunnel still has a state")
+	}
+
+	// A removal followed by an add keeps the menu in title order
+	m.SetTunnels([]manager.Tunnel{{Name: "b"}, {Name: "c"}})
+	for i, name := range []string{"b", "c"} {
+		if tunnel, ok := m.TunnelForSlot(slots[i]); !ok || tunnel.Name != name {
+			t.Fatalf("expected %s in slot %d, got %v", name, i, tunnel)
+		}
+		if item := slotItem(slots[i]); item.hidden || item.title != name {
+			t.Fatalf("slot %d is not shown for %s: %+v", i, name, item)
+		}
+	}
+
+	m.SetTunnels([]manager.Tunnel{{Name: "a"}, {Name: "b"}, {Name: "c"}})
+	if tunnel, ok := m.TunnelForSlot(slots[0]); !ok || tunnel.Name != "a" {
+		t.Fatalf("expected a in the first slot, got %v", tunnel)
+	}
+}
+
+func TestTrayModelStateTransitions(t *testing.T) {
+	slots := newFakeSlots(1)
+	m := newTrayModel(slots, nil, nil)
+	m.SetTunnels([]manager.Tunnel{{Name: "a", State: manager.TunnelStopped}})
+	item := slotItem(slots[0])
+
+	steps := []struct {
+		state    manager.TunnelState
+		err      error
+		title    string
+		tooltip  string
+		checked  bool
+		disabled bool
+	}{
+		{manager.TunnelStarting, nil, "a (Connecting…)", "click to cancel", false, false},
+		{manager.TunnelStarted, nil, "a", "click to deactivate", true, false},
+		{manager.TunnelDegraded, errors.New("lighthouse timed out"), "a (Degraded)", "lighthouse timed out", true, false},
+		{manager.TunnelStopping, nil, "a (Disconnecting…)", "Disconnecting", false, true},
+		{manager.TunnelStopped, errors.New("service failed"), "a", "Inactive: service failed", false, false},
+		{manager.TunnelStopped, nil, "a", "click to activate", false, false},
+	}
+	for _, step := range steps {
+		m.SetState("a", step.state, step.err)
+		if m.State("a") != step.state {
+			t.Fatalf("state is %s after setting %s", m.State("a"), step.state)
+		}
+		if item.title != step.title || !strings.Contains(item.tooltip, step.tooltip) || item.checked != step.checked || item.disabled != step.disabled {
+			t.Fatalf("unexpected entry for %s: %+v", step.state, item)
+		}
+	}
+
+	// A refreshed tunnel list keeps the last reported state
+	m.SetState("a", manager.TunnelStarted, nil)
+	m.SetTunnels([]manager.Tunnel{{Name: "a", DisplayName: "Renamed", State: manager.TunnelStopped}})
+	if m.State("a") != manager.TunnelStarted || !item.checked || item.title != "Renamed" {
+		t.Fatalf("refreshing the tunnels lost the state: %s %+v", m.State("a"), item)
+	}
+
+	m.SetState("unknown", manager.TunnelStarted, nil)
+	if m.State("unknown") != manager.TunnelUnknown {
+		t.Fatal("an unknown tunnel got a state")
+	}
+}
+
+func TestTrayModelOverflow(t *testing.T) {
+	slots := newFakeSlots(1)
+	var created []*tunnelSlot
+	m := newTrayModel(slots, func() *tunnelSlot {
+		s := newFakeSlot()
+		created = append(created, s)
+		return s
+	}, nil)
+
+	m.SetTunnels([]manager.Tunnel{{Name: "a"}, {Name: "b"}, {Name: "c"}})
+	if len(created) != 2 {
+		t.Fatalf("expected 2 overflow slots, got %d", len(created))
+	}
+	for i, s := range created {
+		tunnel, ok := m.TunnelForSlot(s)
+		if !ok || slotItem(s).hidden || slotItem(s).title != tunnel.Name {
+			t.Fatalf("overflow slot %d is not shown for its tunnel: %+v", i, slotItem(s))
+		}
+	}
+
+	// Freed overflow slots are reused before new ones are created
+	m.SetTunnels([]manager.Tunnel{{Name: "a"}})
+	m.SetTunnels([]manager.Tunnel{{Name: "a"}, {Name: "d"}})
+	if len(created) != 2 {
+		t.Fatalf("expected the overflow slots to be reused, %d were created", len(created))
+	}
+
+	// Without a way to add slots, tunnels that do not fit are tracked but not shown
+	m = newTrayModel(newFakeSlots(1), nil, nil)
+	m.SetTunnels([]manager.Tunnel{{Name: "a"}, {Name: "b"}})
+	m.SetState("b", manager.TunnelStarted, nil)
+	if m.State("b") != manager.TunnelStarted {
+		t.Fatal("a tunnel without a slot lost its state")
+	}
+}
+
+func TestTrayModelHidesEmptyOverflow(t *testing.T) {
+	slots := newFakeSlots(1)
+	created, hidden := 0, 0
+	m := newTrayModel(slots, func() *tunnelSlot {
+		created++
+		return newFakeSlot()
+	}, func() bool {
+		hidden++
+		return true
+	})
+
+	m.SetTunnels([]manager.Tunnel{{Name: "a"}, {Name: "b"}})
+	if created != 1 || hidden != 0 {
+		t.Fatalf("created %d and hid %d overflow menus for one tunnel too many", created, hidden)
+	}
+
+	m.SetTunnels([]manager.Tunnel{{Name: "a"}})
+	if hidden != 1 {
+		t.Fatal("the empty overflow menu was not hidden")
+	}
+
+	// Hidden overflow slots are gone, new ones are created when tunnels overflow again
+	m.SetTunnels([]manager.Tunnel{{Name: "a"}, {Name: "c"}})
+	if created != 2 {
+		t.Fatalf("expected a new overflow slot, %d were created", created)
+	}
+}
@@ -1,6 +1,7 @@
 package ui
 
 import (
+	"context"
 	"fmt"
 	"github.com/getlantern/systray"
 	"golang.org/x/sys/windows"
@@ -8,118 +9,404 @@ import (
 	"nebula-windows-ui/manager"
 	"os"
 	"path/filepath"
+	"strings"
+	"sync"
+	"time"
 )
 
+const (
+	idYes             = 6
+	reloadGracePeriod = 10 * time.Second
+	// How long a tunnel started with newly committed artifacts is watched before they are kept
+	artifactStartTimeout = 30 * time.Second
+)
+
+var (
+	lastActivated      = make(map[string]time.Time)
+	pendingActivations = make(map[string]context.CancelFunc)
+	activatedLock      sync.Mutex
+)
+
+const (
+	reservedTunnelSlots = 16
+	// systray destroys the submenu of a hidden item, so every time tunnels overflow again a fresh one is needed
+	reservedMoreMenus = 4
+)
+
+var tray *trayModel
+
 func ShowError(heading string, msg string) {
 	windows.MessageBox(0, windows.StringToUTF16Ptr(msg), windows.StringToUTF16Ptr(heading), windows.MB_ICONERROR)
 }
 
-func ToggleTunnel(selectedTunnel *manager.Tunnel) error {
-	if selectedTunnel.State == manager.TunnelStarted {
-		selectedTunnel.State = manager.TunnelStopping
-		log.Printf("Deactivating %s\n", selectedTunnel.Name)
-		err := manager.IPCClientStopTunnel(selectedTunnel.Name)
+// cancelActivation cancels the controller requests and login of a tunnel that is being activated. It reports
+// whether an activation was pending.
+func cancelActivation(tunnelName string) bool {
+	activatedLock.Lock()
+	defer activatedLock.Unlock()
+	cancel, ok := pendingActivations[tunnelName]
+	if ok {
+		cancel()
+	}
+	return ok
+}
+
+func ActivateTunnel(selectedTunnel manager.Tunnel) error {
+	log.Printf("Connecting to selected tunnel %s at %s\n", &selectedTunnel, selectedTunnel.Path)
+	ctx, cancel := context.WithCancel(context.Background())
+	activatedLock.Lock()
+	lastActivated[selectedTunnel.Name] = time.Now()
+	pendingActivations[selectedTunnel.Name] = cancel
+	activatedLock.Unlock()
+	defer func() {
+		activatedLock.Lock()
+		delete(pendingActivations, selectedTunnel.Name)
+		activatedLock.Unlock()
+		cancel()
+	}()
+
+	tray.SetState(selectedTunnel.Name, manager.TunnelStarting, nil)
+
+	fail := func(heading string, msg string, err error) error {
+		if ctx.Err() != nil {
+			log.Printf("Activation of %s was canceled\n", &selectedTunnel)
+			tray.SetState(selectedTunnel.Name, manager.TunnelStopped, nil)
+			return ctx.Err()
+		}
+		tray.SetState(selectedTunnel.Name, manager.TunnelStopped, err)
+		ShowError(heading, msg)
+		return err
+	}
+
+	md, err := manager.LoadTunnelMetadata(selectedTunnel.Path)
+	if err != nil {
+		return fail("Error reading tunnel metadata", fmt.Sprintf("%s", err), err)
+	}
+
+	committed := false
+	if md != nil && md.ControllerURL != "" {
+		log.Printf("Controller managed tunnel - %s\n", selectedTunnel.Path)
+		client, err := controllerClient(ctx, selectedTunnel, md)
 		if err != nil {
-			ShowError("Error deactivating tunnel", fmt.Sprintf("%s", err))
-			return err
+			return fail("Error verifying controller", fmt.Sprintf("%s", err), err)
 		}
-		selectedTunnel.State = manager.TunnelStopped
-	} else {
 
-		log.Printf("Connecting to selected tunnel %s\n", selectedTunnel.Path)
-		md := manager.LoadTunnelMetadata(selectedTunnel.Path)
+		nc, err := GetControllerInfo(ctx, client, md.ControllerURL)
 
-		if md != nil && md.ControllerURL != "" {
-			log.Printf("Controller managed tunnel - %s\n", selectedTunnel.Path)
-			nc, err := GetControllerInfo(md.ControllerURL)
+		if err != nil {
+			return fail("Error talking to controller", fmt.Sprintf("%s", err), err)
+		}
 
-			if err != nil {
-				ShowError("Error talking to controller", fmt.Sprintf("%s", err))
-				return err
-			}
-			accessToken, err := DoOIDCLogin(nc.OidcConfigURL, nc.OidcClientID)
-			if err != nil {
-				ShowError("Error after OIDC login", fmt.Sprintf("%s", err))
-				return err
-			}
+		err = verifyControllerCA(selectedTunnel, md, nc.CACert)
+		if err != nil {
+			return fail("Nebula CA changed", fmt.Sprintf("%s\n\nThe tunnel was not started. Contact your administrator before trusting the new CA.", err), err)
+		}
 
-			err = CreateTempConfig(accessToken, selectedTunnel.Path, nc)
+		plan := planKeyLifecycle(selectedTunnel.Path, md, nc.CACert, time.Now())
+		log.Printf("Key lifecycle of %s: %s\n", &selectedTunnel, plan)
 
+		var accessToken string
+		if plan.Sign || nc.NodeConfigEndpoint != "" {
+			// The identity provider is not the controller, so its key is not pinned
+			oidcClient, err := newHTTPClient(md.HTTP, "")
+			if err == nil {
+				accessToken, err = DoOIDCLogin(ctx, oidcClient, nc.OidcConfigURL, nc.OidcClientID)
+			}
 			if err != nil {
-				ShowError("Error creating temp config", fmt.Sprintf("%s", err))
-				return err
+				return fail("Error after OIDC login", fmt.Sprintf("%s", err), err)
 			}
 		}
 
-		selectedTunnel.State = manager.TunnelStarting
+		committed, err = CreateTempConfig(ctx, client, accessToken, selectedTunnel.Path, nc, plan)
 
-		tunnel, err := manager.IPCClientStartTunnel(selectedTunnel.Path)
 		if err != nil {
-			ShowError("Error activating tunnel", fmt.Sprintf("Tunnel start threw error: %s", err))
-			return err
+			return fail("Error creating temp config", fmt.Sprintf("%s", err), err)
 		}
+	}
+	// From here on the tunnel can no longer be canceled, clicking it stops it instead
+	activatedLock.Lock()
+	delete(pendingActivations, selectedTunnel.Name)
+	canceled := ctx.Err() != nil
+	activatedLock.Unlock()
+	if canceled {
+		// Canceled after the last request finished, the new artifacts are kept for the next activation
+		return fail("", "", ctx.Err())
+	}
+
+	_, err = manager.IPCClientStartTunnel(selectedTunnel.Path)
+	if err != nil {
+		tray.SetState(selectedTunnel.Name, manager.TunnelStopped, err)
+		msg := fmt.Sprintf("Tunnel start threw error: %s", err)
+		if committed {
+			msg += "\n\n" + rollbackArtifacts(selectedTunnel)
+		}
+		ShowError("Error activating tunnel", msg)
+		return err
+	}
+	if committed {
+		go watchArtifactStart(selectedTunnel)
+	}
+
+	return nil
+}
+
+// watchArtifactStart rolls the artifacts of a tunnel back to the previous generation if the tunnel fails before it
+// comes up with the ones that were just committed. A tunnel the user stops in the meantime keeps them.
+func watchArtifactStart(t manager.Tunnel) {
+	deadline := time.Now().Add(artifactStartTimeout)
+	for time.Now().Before(deadline) {
+		time.Sleep(time.Second)
+		state, err := manager.IPCClientTunnelState(t.Name)
+		switch {
+		case state == manager.TunnelStopped && err != nil:
+			ShowError("Error activating tunnel", fmt.Sprintf("Tunnel %s failed while starting with its new certificate: %s\n\n%s", t.Title(), err, rollbackArtifacts(t)))
+			return
+		case state == manager.TunnelStopped:
+			// Stopped by the user, the new artifacts were never tried
+			return
+		case state == manager.TunnelStarted, state == manager.TunnelDegraded:
+			return
+		case err != nil:
+			log.Printf("Could not watch the start of %s: %s\n", &t, err)
+			return
+		}
+	}
+}
 
-		selectedTunnel.State = tunnel.State
-		selectedTunnel.Name = tunnel.Name
+func rollbackArtifacts(t manager.Tunnel) string {
+	err := manager.RollbackArtifacts(t.Path)
+	if err != nil {
+		log.Printf("Could not roll back artifacts of %s: %s\n", &t, err)
+		return fmt.Sprintf("The previous key and certificate could not be restored: %s", err)
 	}
+	return "The previous key and certificate were restored."
+}
 
+func DeactivateTunnel(selectedTunnel manager.Tunnel) error {
+	log.Printf("Deactivating %s\n", &selectedTunnel)
+	tray.SetState(selectedTunnel.Name, manager.TunnelStopping, nil)
+
+	err := manager.IPCClientStopTunnel(selectedTunnel.Name)
+	if err != nil {
+		state, stateErr := manager.IPCClientTunnelState(selectedTunnel.Name)
+		tray.SetState(selectedTunnel.Name, state, stateErr)
+		ShowError("Error deactivating tunnel", fmt.Sprintf("%s", err))
+		return err
+	}
+
+	tray.SetState(selectedTunnel.Name, manager.TunnelStopped, nil)
 	return nil
 }
 
+func showTunnelLog(t manager.Tunnel) {
+	cmdToRun := "C:\\Windows\\System32\\notepad.exe"
+	args := []string{"notepad.exe", filepath.Join(t.Path, "tunnel.log")}
+	procAttr := new(os.ProcAttr)
+	procAttr.Files = []*os.File{os.Stdin, os.Stdout, os.Stderr}
+	if _, err := os.StartProcess(cmdToRun, args, procAttr); err != nil {
+		ShowError("Error displaying log file", fmt.Sprintf("%v", err))
+	}
+}
+
+func offerReload(tunnelName string) {
+	t, ok := manager.Tunnels.Get(tunnelName)
+	if !ok {
+		return
+	}
+
+	state, err := manager.IPCClientTunnelState(tunnelName)
+	if err != nil || (state != manager.TunnelStarted && state != manager.TunnelDegraded) {
+		return
+	}
+
+	activatedLock.Lock()
+	recent := time.Since(lastActivated[tunnelName]) < reloadGracePeriod
+	activatedLock.Unlock()
+	if recent {
+		// Controller managed tunnels rewrite their config on every activation
+		return
+	}
+
+	ret, _ := windows.MessageBox(0, windows.StringToUTF16Ptr(fmt.Sprintf("The configuration of tunnel %s has changed. Reconnect now to apply it?", t.Title())), windows.StringToUTF16Ptr("Nebula"), windows.MB_YESNO|windows.MB_ICONQUESTION)
+	if ret != idYes {
+		return
+	}
+
+	log.Printf("Reloading %s\n", tunnelName)
+	err = manager.IPCClientStopTunnel(tunnelName)
+	if err != nil {
+		ShowError("Error deactivating tunnel", fmt.Sprintf("%s", err))
+		return
+	}
+	_, err = manager.IPCClientStartTunnel(t.Path)
+	if err != nil {
+		ShowError("Error activating tunnel", fmt.Sprintf("Tunnel start threw error: %s", err))
+	}
+}
+
+// reportTunnelConflicts warns about tunnels that can not run side by side before the user tries to start them.
+func reportTunnelConflicts() {
+	conflicts := manager.LintTunnels(manager.Tunnels.Snapshot())
+	if len(conflicts) == 0 {
+		return
+	}
+
+	lines := make([]string, 0, len(conflicts))
+	for _, c := range conflicts {
+		log.Printf("Tunnel conflict: %s\n", c)
+		lines = append(lines, c.String())
+	}
+	msg := fmt.Sprintf("These tunnels can not be active at the same time:\n\n%s", strings.Join(lines, "\n"))
+	windows.MessageBox(0, windows.StringToUTF16Ptr(msg), windows.StringToUTF16Ptr("Nebula"), windows.MB_ICONWARNING)
+}
+
 func RunUI() {
 	manager.LoadTunnelConfigs()
+	go reportTunnelConflicts()
+
+	err := RegisterEnrollURLHandler()
+	if err != nil {
+		log.Printf("Unable to register the %s:// link handler: %v\n", manager.EnrollScheme, err)
+	}
+
+	watcher, err := manager.WatchTunnelConfigs(func(tunnelName string) {
+		go offerReload(tunnelName)
+	})
+	if err != nil {
+		log.Printf("Unable to watch tunnel configs: %v\n", err)
+	} else {
+		defer watcher.Stop()
+	}
 
 	systray.Run(onReady, onQuit)
 }
 
+func newTunnelSlot(item *systray.MenuItem, logMenu *systray.MenuItem) *tunnelSlot {
+	showLog := logMenu.AddSubMenuItem("", "Show log")
+	slot := &tunnelSlot{
+		item:    item,
+		showLog: showLog,
+	}
+
+	go func() {
+		for {
+			select {
+			case <-item.ClickedCh:
+				t, ok := tray.TunnelForSlot(slot)
+				if !ok {
+					continue
+				}
+				switch tray.State(t.Name) {
+				case manager.TunnelStopped, manager.TunnelUnknown:
+					go ActivateTunnel(t)
+				case manager.TunnelStopping:
+				case manager.TunnelStarting:
+					if !cancelActivation(t.Name) {
+						go DeactivateTunnel(t)
+					}
+				default:
+					go DeactivateTunnel(t)
+				}
+			case <-showLog.ClickedCh:
+				t, ok := tray.TunnelForSlot(slot)
+				if ok {
+					showTunnelLog(t)
+				}
+			}
+		}
+	}()
+	return slot
+}
+
 func onReady() {
 	systray.SetTemplateIcon(Icon, Icon)
 	systray.SetTitle("Nebula")
 	systray.SetTooltip("Nebula")
 
-	for _, t := range manager.CurrentTunnels {
-		tunnelMenu := systray.AddMenuItemCheckbox(t.Name, "Active", false)
-		activate := tunnelMenu.AddSubMenuItem("Activate", "Activate tunnel")
-		deactivate := tunnelMenu.AddSubMenuItem("Deactivate", "Deactivate tunnel")
-		deactivate.Disable()
-		showLog := tunnelMenu.AddSubMenuItem("Show Log", "Show log")
-
-		t := t
-		go func() {
-			for {
-				select {
-				case <-activate.ClickedCh:
-					log.Printf("Activate %s\n", t.Name)
-					err := ToggleTunnel(&t)
-					if err == nil {
-						activate.Disable()
-						deactivate.Enable()
-						tunnelMenu.Check()
-					}
-				case <-deactivate.ClickedCh:
-					log.Printf("Deactivate %s\n", t.Name)
-					err := ToggleTunnel(&t)
-					if err == nil {
-						activate.Enable()
-						deactivate.Disable()
-						tunnelMenu.Uncheck()
-					}
-				case <-showLog.ClickedCh:
-					cmdToRun := "C:\\Windows\\System32\\notepad.exe"
-					args := []string{"notepad.exe", filepath.Join(t.Path, "tunnel.log")}
-					procAttr := new(os.ProcAttr)
-					procAttr.Files = []*os.File{os.Stdin, os.Stdout, os.Stderr}
-					if _, err := os.StartProcess(cmdToRun, args, procAttr); err != nil {
-						ShowError("Error displaying log file", fmt.Sprintf("%v", err))
-					}
-				}
-			}
-		}()
+	// systray can only append items, so tunnel entries are reserved up front to keep them above the separator.
+	// Tunnels that do not fit go into a submenu, which is reserved too and only shown while it is needed.
+	items := make([]*systray.MenuItem, reservedTunnelSlots)
+	for i := range items {
+		items[i] = systray.AddMenuItemCheckbox("", "", false)
+	}
+	moreMenus := make([]*systray.MenuItem, reservedMoreMenus)
+	for i := range moreMenus {
+		moreMenus[i] = systray.AddMenuItem("More Tunnels", "Tunnels that do not fit in this menu")
+		moreMenus[i].Hide()
 	}
-
+	systray.AddSeparator()
+	logMenu := systray.AddMenuItem("Show Log", "Show tunnel logs")
 	systray.AddSeparator()
 	mQuitOrig := systray.AddMenuItem("Quit", "Quit Nebula")
 
+	slots := make([]*tunnelSlot, 0, reservedTunnelSlots)
+	for _, item := range items {
+		slots = append(slots, newTunnelSlot(item, logMenu))
+	}
+	var moreMenu *systray.MenuItem
+	usedMoreMenus := 0
+	tray = newTrayModel(slots, func() *tunnelSlot {
+		if moreMenu == nil {
+			if usedMoreMenus == len(moreMenus) {
+				return nil
+			}
+			// Shown before it gets its first item, as systray drops the submenu of an item that is hidden later
+			moreMenu = moreMenus[usedMoreMenus]
+			usedMoreMenus++
+			moreMenu.Show()
+		}
+		return newTunnelSlot(moreMenu.AddSubMenuItemCheckbox("", "", false), logMenu)
+	}, func() bool {
+		// The last submenu stays, there is none left to take its place
+		if moreMenu == nil || usedMoreMenus == len(moreMenus) {
+			return false
+		}
+		moreMenu.Hide()
+		moreMenu = nil
+		return true
+	})
+
+	manager.IPCClientRegisterTunnelChange(func(tunnelName string, state manager.TunnelState, globalState manager.TunnelState, err error) {
+		if err != nil {
+			log.Printf("Tunnel %s is %s: %s\n", tunnelName, state, err)
+		}
+		manager.Tunnels.SetState(tunnelName, state)
+		tray.SetState(tunnelName, state, err)
+		switch globalState {
+		case manager.TunnelStarted:
+			systray.SetTooltip("Nebula: Connected")
+		case manager.TunnelStarting:
+			systray.SetTooltip("Nebula: Connecting…")
+		default:
+			systray.SetTooltip("Nebula")
+		}
+	})
+	manager.IPCClientRegisterTunnelsChange(func() {
+		manager.ReloadTunnelConfigs()
+	})
+	manager.Tunnels.Subscribe(func() {
+		tray.SetTunnels(manager.Tunnels.Snapshot())
+	})
+
+	tray.SetTunnels(manager.Tunnels.Snapshot())
+	go func() {
+		for _, t := range manager.Tunnels.Snapshot() {
+			state, err := manager.IPCClientTunnelState(t.Name)
+			if state == manager.TunnelUnknown {
+				continue
+			}
+			tray.SetState(t.Name, state, err)
+			if state != manager.TunnelStopped {
+				continue
+			}
+			md, err := manager.LoadTunnelMetadata(t.Path)
+			if err == nil && md != nil && md.AutoConnect {
+				log.Printf("Auto-connecting %s\n", &t)
+				go ActivateTunnel(t)
+			}
+		}
+	}()
+
 	go func() {
 		<-mQuitOrig.ClickedCh
 		systray.Quit()